@@ -0,0 +1,228 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// Decision outcomes
+const (
+	outcomeAllow     = "allow"
+	outcomeDeny      = "deny"
+	outcomeForbidden = "forbidden"
+	outcomeLocked    = "locked"
+	outcomeError     = "error"
+)
+
+const redacted = "[REDACTED]"
+
+// decision records how a protected request was handled
+type decision struct {
+	r          *http.Request
+	start      time.Time
+	rule       string
+	username   string
+	backends   []string
+	outcome    string
+	reason     string
+	latency    time.Duration
+	reportOnly bool
+}
+
+func newDecision(r *http.Request, p Rule) *decision {
+	un, _, _ := r.BasicAuth()
+	return &decision{
+		r:          r,
+		start:      time.Now(),
+		rule:       p.label(),
+		username:   un,
+		reportOnly: p.reportOnly,
+	}
+}
+
+// decide records the outcome of the request
+func (d *decision) decide(outcome, reason string) {
+	d.outcome = outcome
+	d.reason = reason
+	d.latency = time.Since(d.start)
+}
+
+// auditEntry is a single line of the audit log
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	Rule       string    `json:"rule"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	ClientIP   string    `json:"client_ip"`
+	Username   string    `json:"username,omitempty"`
+	Backend    string    `json:"backend,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Reason     string    `json:"reason,omitempty"`
+	Latency    float64   `json:"latency_ms"`
+	ReportOnly bool      `json:"report_only,omitempty"`
+}
+
+// auditLog writes a json line per decision
+type auditLog struct {
+	output  string
+	w       io.Writer
+	proxies []*net.IPNet
+	header  string
+}
+
+func parseAuditLog(args []string) (*auditLog, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, fmt.Errorf("wrong number of arguments")
+	}
+
+	a := &auditLog{output: args[0], header: backend.DefaultForwardedHeader}
+
+	var options map[string]string
+	if len(args) == 2 {
+		var err error
+		if options, err = backend.ParseOptions(args[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	roller := httpserver.DefaultLogRoller()
+	roller.Filename = a.output
+
+	var rotate bool
+	for k, v := range options {
+		var err error
+		switch k {
+		case "rotate_size":
+			roller.MaxSize, err = strconv.Atoi(v)
+		case "rotate_age":
+			roller.MaxAge, err = strconv.Atoi(v)
+		case "rotate_keep":
+			roller.MaxBackups, err = strconv.Atoi(v)
+		case "rotate_compress":
+			roller.Compress, err = strconv.ParseBool(v)
+		case "trusted_proxies":
+			a.proxies, err = backend.ParseNetworks(v)
+		case "forwarded_header":
+			a.header, err = backend.ParseForwardedHeader(v)
+		default:
+			err = fmt.Errorf("unknown option %v", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+		rotate = rotate || strings.HasPrefix(k, "rotate_")
+	}
+
+	switch a.output {
+	case "stderr":
+		a.w = os.Stderr
+	case "stdout":
+		a.w = os.Stdout
+	default:
+		a.w = roller.GetLogWriter()
+		return a, nil
+	}
+
+	if rotate {
+		return nil, fmt.Errorf("rotation is only supported for files")
+	}
+
+	return a, nil
+}
+
+// record writes the decision to the audit log, it's safe to call on a nil log
+func (a *auditLog) record(d *decision) {
+	if a == nil || d.outcome == "" {
+		return
+	}
+
+	clientIP := "unknown"
+	if ip := backend.ClientIP(d.r, a.proxies, a.header); ip != nil {
+		clientIP = ip.String()
+	}
+
+	b, err := json.Marshal(auditEntry{
+		Time:       d.start,
+		Rule:       d.rule,
+		Method:     d.r.Method,
+		Path:       d.r.URL.Path,
+		ClientIP:   clientIP,
+		Username:   redact(d.r, d.username),
+		Backend:    strings.Join(d.backends, ","),
+		Outcome:    d.outcome,
+		Reason:     redact(d.r, d.reason),
+		Latency:    float64(d.latency) / float64(time.Millisecond),
+		ReportOnly: d.reportOnly,
+	})
+	if err != nil {
+		log.Printf("[ERROR] reauth: unable to encode audit entry: %v", err)
+		return
+	}
+
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		log.Printf("[ERROR] reauth: unable to write audit log %s: %v", a.output, err)
+	}
+}
+
+// redact removes any passwords or tokens presented with the request from s
+func redact(r *http.Request, s string) string {
+	if s == "" {
+		return s
+	}
+
+	var secrets []string
+	if _, pw, ok := r.BasicAuth(); ok {
+		secrets = append(secrets, pw)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		secrets = append(secrets, auth)
+		if i := strings.IndexByte(auth, ' '); i >= 0 {
+			secrets = append(secrets, strings.TrimSpace(auth[i+1:]))
+		}
+	}
+	for _, c := range r.Cookies() {
+		secrets = append(secrets, c.Value)
+	}
+
+	for _, secret := range secrets {
+		if len(secret) > 0 {
+			s = strings.Replace(s, secret, redacted, -1)
+		}
+	}
+	return s
+}
@@ -0,0 +1,151 @@
+package reauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+func TestRedact(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "hunter2")
+	r.AddCookie(&http.Cookie{Name: "session", Value: "c00k1e"})
+
+	got := redact(r, "bind with bob/hunter2 failed, cookie c00k1e")
+	if expect := "bind with bob/[REDACTED] failed, cookie [REDACTED]"; got != expect {
+		t.Errorf("Expected `%v` got `%v`", expect, got)
+	}
+
+	r.Header.Set("Authorization", "Bearer s3cr3t-t0k3n")
+	got = redact(r, "token s3cr3t-t0k3n rejected")
+	if expect := "token [REDACTED] rejected"; got != expect {
+		t.Errorf("Expected `%v` got `%v`", expect, got)
+	}
+}
+
+func TestMiddlewareAudit(t *testing.T) {
+	test := `reauth {
+				name private
+				path /test
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	var buf bytes.Buffer
+	rules[0].audit = &auditLog{output: "test", w: &buf}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	for _, pw := range []string{"password", "wrong"} {
+		req, _ := http.NewRequest("GET", "/test/page?token=abc", nil)
+		req.RemoteAddr = "203.0.113.1:1234"
+		req.SetBasicAuth("username", pw)
+		if _, err := auth.ServeHTTP(httptest.NewRecorder(), req); err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/public", nil)
+	auth.ServeHTTP(httptest.NewRecorder(), req)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 audit entries got %d: %v", len(lines), lines)
+	}
+
+	expect := []auditEntry{
+		{Rule: "private", Method: "GET", Path: "/test/page", ClientIP: "203.0.113.1", Username: "username", Backend: "simple", Outcome: outcomeAllow},
+		{Rule: "private", Method: "GET", Path: "/test/page", ClientIP: "203.0.113.1", Username: "username", Outcome: outcomeDeny, Reason: "rejected by all backends"},
+	}
+
+	for i, line := range lines {
+		if strings.Contains(line, "password") || strings.Contains(line, "wrong") {
+			t.Errorf("Credentials leaked into the audit log: %s", line)
+		}
+
+		var got auditEntry
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+			continue
+		}
+		if got.Time.IsZero() {
+			t.Error("Expected a timestamp")
+		}
+		got.Time = expect[i].Time
+		got.Latency = 0
+		if got != expect[i] {
+			t.Errorf("Expected %+v got %+v", expect[i], got)
+		}
+	}
+}
+
+func TestMiddlewareAuditProxies(t *testing.T) {
+	test := `reauth {
+				path /test
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	proxies, _ := backend.ParseNetworks("192.168.0.1")
+	var buf bytes.Buffer
+	rules[0].audit = &auditLog{output: "test", w: &buf, proxies: proxies, header: backend.DefaultForwardedHeader}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	tests := []struct {
+		desc   string
+		remote string
+		xff    string
+		expect string
+	}{
+		{"direct client", "203.0.113.1:1234", "", "203.0.113.1"},
+		{"spoofed forwarding header", "203.0.113.1:1234", "10.1.1.1", "203.0.113.1"},
+		{"client behind proxy", "192.168.0.1:1234", "10.1.1.1", "10.1.1.1"},
+		{"garbage behind proxy", "192.168.0.1:1234", "nonsense", "unknown"},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing audit client address %d (%s)", i+1, tc.desc)
+		buf.Reset()
+
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		req.SetBasicAuth("username", "password")
+		auth.ServeHTTP(httptest.NewRecorder(), req)
+
+		var got auditEntry
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+			continue
+		}
+		if got.ClientIP != tc.expect {
+			t.Errorf("Expected client_ip `%v` got `%v`", tc.expect, got.ClientIP)
+		}
+	}
+}
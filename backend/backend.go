@@ -25,6 +25,7 @@
 package backend
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strconv"
@@ -38,6 +39,100 @@ type Backend interface {
 	Authenticate(r *http.Request) (bool, error)
 }
 
+// Identity describes the principal a backend authenticated
+type Identity struct {
+	Username string
+	Groups   []string
+	Claims   map[string]string
+}
+
+// IdentityBackend is implemented by backends that can report who they authenticated.
+type IdentityBackend interface {
+	Backend
+	// AuthenticateIdentity checks the request against the backend and returns the
+	// authenticated identity, a nil identity means authentication failed.
+	// If the error parameter is not nil then a communications error must have occurred
+	AuthenticateIdentity(r *http.Request) (*Identity, error)
+}
+
+// Identify authenticates the request against the given backend, backends that
+// don't implement IdentityBackend don't say who they authenticated so they're
+// given an anonymous identity rather than whatever username the client sent
+func Identify(b Backend, r *http.Request) (*Identity, error) {
+	if ib, ok := b.(IdentityBackend); ok {
+		return ib.AuthenticateIdentity(r)
+	}
+
+	ok, err := b.Authenticate(r)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return &Identity{}, nil
+}
+
+// ContextBackend is implemented by backends that stop working on a request
+// once its context is cancelled or its deadline passes.
+type ContextBackend interface {
+	Backend
+	// AuthenticateContext checks the request against the backend within the
+	// lifetime of the context and returns the authenticated identity, a nil
+	// identity means authentication failed.
+	// If the error parameter is not nil then a communications error must have occurred
+	// or the context is done
+	AuthenticateContext(ctx context.Context, r *http.Request) (*Identity, error)
+}
+
+// IdentifyContext authenticates the request against the given backend within
+// the lifetime of the context
+func IdentifyContext(ctx context.Context, b Backend, r *http.Request) (*Identity, error) {
+	return WithContext(b).AuthenticateContext(ctx, r)
+}
+
+// WithContext returns the backend as a ContextBackend, backends that don't
+// implement it are adapted so that the caller gives up on them when the
+// context is done although they will still run to completion
+func WithContext(b Backend) ContextBackend {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb
+	}
+	return contextAdapter{b}
+}
+
+type contextAdapter struct {
+	Backend
+}
+
+func (a contextAdapter) AuthenticateContext(ctx context.Context, r *http.Request) (*Identity, error) {
+	if ctx.Done() == nil {
+		return Identify(a.Backend, r)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		id  *Identity
+		err error
+	}
+
+	// The backend may outlive the request once abandoned so it gets a copy
+	// that the handlers that follow can't change underneath it
+	done := make(chan result, 1)
+	go func(r *http.Request) {
+		id, err := Identify(a.Backend, r)
+		done <- result{id, err}
+	}(r.Clone(ctx))
+
+	select {
+	case res := <-done:
+		return res.id, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 type Constructor func(config string) (Backend, error)
 
 var backends = map[string]Constructor{}
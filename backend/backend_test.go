@@ -1,8 +1,11 @@
 package backend_test
 
 import (
+	"context"
 	"fmt"
+	"net/http"
 	"testing"
+	"time"
 
 	"github.com/freman/caddy-reauth/backend"
 )
@@ -43,3 +46,87 @@ func TestParseOptions(t *testing.T) {
 	}
 
 }
+
+type legacyBackend struct{}
+
+func (legacyBackend) Authenticate(r *http.Request) (bool, error) {
+	_, pw, _ := r.BasicAuth()
+	return pw == "secret", nil
+}
+
+func TestIdentify(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "wrong")
+
+	id, err := backend.Identify(legacyBackend{}, r)
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if id != nil {
+		t.Errorf("Expected no identity, got %v", id)
+	}
+
+	r.SetBasicAuth("bob", "secret")
+	id, err = backend.Identify(legacyBackend{}, r)
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	if id == nil || id.Username != "" {
+		t.Errorf("Expected an anonymous identity, got %v", id)
+	}
+}
+
+type slowBackend struct {
+	delay time.Duration
+}
+
+func (b slowBackend) Authenticate(r *http.Request) (bool, error) {
+	time.Sleep(b.delay)
+	_, _, ok := r.BasicAuth()
+	return ok, nil
+}
+
+func TestIdentifyContext(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "secret")
+
+	t.Log("Testing legacy backends without a deadline")
+	id, err := backend.IdentifyContext(context.Background(), legacyBackend{}, r)
+	if err != nil || id == nil {
+		t.Errorf("Expected an identity, got %v (%v)", id, err)
+	}
+
+	t.Log("Testing legacy backends are abandoned at the deadline")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	id, err = backend.IdentifyContext(ctx, slowBackend{delay: time.Second}, r)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected %v got %v", context.DeadlineExceeded, err)
+	}
+	if id != nil {
+		t.Errorf("Expected no identity, got %v", id)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the backend to be abandoned, took %v", elapsed)
+	}
+
+	t.Log("Testing abandoned legacy backends don't share the request")
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err = backend.IdentifyContext(ctx, slowBackend{delay: 50 * time.Millisecond}, r); err != context.DeadlineExceeded {
+		t.Errorf("Expected %v got %v", context.DeadlineExceeded, err)
+	}
+	for end := time.Now().Add(100 * time.Millisecond); time.Now().Before(end); {
+		r.Header.Set("X-Downstream", "value")
+		r.Header.Del("X-Downstream")
+	}
+
+	t.Log("Testing context backends are used directly")
+	cb := backend.WithContext(slowBackend{})
+	if backend.WithContext(cb) != cb {
+		t.Error("Expected context backends to be returned as is")
+	}
+}
@@ -0,0 +1,318 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package backend
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Breaker defaults
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerInterval  = 30 * time.Second
+)
+
+// Breaker states
+const (
+	BreakerClosed = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+var breakerStates = map[int]string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half_open",
+}
+
+// ErrBreakerOpen is returned without asking the backend while its breaker is open
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// HealthChecker is implemented by backends that can check their server is
+// available without any credentials.
+type HealthChecker interface {
+	// HealthCheck returns an error if the server can't be reached
+	HealthCheck(ctx context.Context) error
+}
+
+// CheckURL is a health check for http servers, any response at all means the
+// server is available
+func CheckURL(ctx context.Context, u string, timeout time.Duration, insecureSkipVerify bool) error {
+	c := &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	if insecureSkipVerify {
+		c.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+var (
+	breakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "reauth",
+		Name:      "breaker_state",
+		Help:      "Circuit breaker state by backend, 0 closed, 1 open and 2 half open.",
+	}, []string{"backend"})
+
+	breakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "reauth",
+		Name:      "breaker_transitions_total",
+		Help:      "Circuit breaker state changes by backend and new state.",
+	}, []string{"backend", "state"})
+)
+
+func init() {
+	prometheus.MustRegister(breakerState, breakerTransitions)
+}
+
+// Breaker wraps a backend failing fast once it has returned threshold errors
+// in a row. While open backends that implement HealthChecker are checked
+// every interval and the breaker closes once they're healthy, other backends
+// are given a single request every interval to prove themselves.
+type Breaker struct {
+	backend   Backend
+	name      string
+	threshold int
+	interval  time.Duration
+
+	mu       sync.Mutex
+	state    int
+	errors   int
+	opened   time.Time
+	lastUsed time.Time
+	probing  bool
+}
+
+// NewBreaker returns a backend that stops asking b after threshold
+// consecutive errors, name identifies it in logs and metrics.
+func NewBreaker(b Backend, name string, threshold int, interval time.Duration) *Breaker {
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	if interval <= 0 {
+		interval = DefaultBreakerInterval
+	}
+
+	c := &Breaker{
+		backend:   b,
+		threshold: threshold,
+		interval:  interval,
+	}
+	c.SetName(name)
+	return c
+}
+
+// SetName changes the name identifying the breaker in logs and metrics, for
+// when it isn't known until after the breaker is made
+func (c *Breaker) SetName(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.name != "" {
+		breakerState.DeleteLabelValues(c.name)
+	}
+	c.name = name
+	if name != "" {
+		breakerState.WithLabelValues(name).Set(float64(c.state))
+	}
+}
+
+// Authenticate fulfils the backend interface
+func (c *Breaker) Authenticate(r *http.Request) (bool, error) {
+	id, err := c.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (c *Breaker) AuthenticateIdentity(r *http.Request) (*Identity, error) {
+	return c.AuthenticateContext(r.Context(), r)
+}
+
+// AuthenticateContext fulfils the context backend interface
+func (c *Breaker) AuthenticateContext(ctx context.Context, r *http.Request) (*Identity, error) {
+	allowed, trial := c.allow()
+	if !allowed {
+		return nil, ErrBreakerOpen
+	}
+
+	id, err := IdentifyContext(ctx, c.backend, r)
+
+	// Requests abandoned by the caller say nothing about the backend, but an
+	// abandoned trial must make way for another
+	if ctx.Err() == context.Canceled {
+		if trial {
+			c.abandon()
+		}
+		return id, err
+	}
+
+	c.record(err)
+	return id, err
+}
+
+// State returns the current state of the breaker
+func (c *Breaker) State() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// allow reports whether a request may be passed to the backend and whether
+// it is the single trial request of a half open breaker
+func (c *Breaker) allow() (allowed, trial bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastUsed = time.Now()
+
+	switch c.state {
+	case BreakerClosed:
+		return true, false
+	case BreakerOpen:
+		if hc, ok := c.backend.(HealthChecker); ok {
+			if !c.probing {
+				c.probing = true
+				go c.probe(hc)
+			}
+			return false, false
+		}
+		if time.Since(c.opened) >= c.interval {
+			c.transition(BreakerHalfOpen)
+			return true, true
+		}
+	}
+
+	return false, false
+}
+
+// abandon reopens a half open breaker whose trial request was cancelled so
+// another trial is allowed after the interval
+func (c *Breaker) abandon() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == BreakerHalfOpen {
+		c.opened = time.Now()
+		c.transition(BreakerOpen)
+	}
+}
+
+// record counts the outcome of a request passed to the backend
+func (c *Breaker) record(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		c.errors = 0
+		if c.state != BreakerClosed {
+			c.transition(BreakerClosed)
+		}
+		return
+	}
+
+	c.errors++
+	if c.state == BreakerHalfOpen || (c.state == BreakerClosed && c.errors >= c.threshold) {
+		log.Printf("[WARNING] reauth: backend %s failed %d times in a row, last with: %v", c.name, c.errors, err)
+		c.opened = time.Now()
+		c.transition(BreakerOpen)
+
+		if hc, ok := c.backend.(HealthChecker); ok && !c.probing {
+			c.probing = true
+			go c.probe(hc)
+		}
+	}
+}
+
+// probe checks the health of the backend every interval until it is healthy
+// or the breaker hasn't been used for a while, in which case the next request
+// starts probing again
+func (c *Breaker) probe(hc HealthChecker) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+		err := hc.HealthCheck(ctx)
+		cancel()
+
+		c.mu.Lock()
+		if err == nil {
+			c.errors = 0
+			c.transition(BreakerClosed)
+			c.probing = false
+			c.mu.Unlock()
+			return
+		}
+		idle := time.Since(c.lastUsed) > 10*c.interval
+		if idle {
+			c.probing = false
+		}
+		c.mu.Unlock()
+
+		if idle {
+			return
+		}
+	}
+}
+
+// transition changes state, the lock must be held
+func (c *Breaker) transition(state int) {
+	if c.state == state {
+		return
+	}
+
+	log.Printf("[INFO] reauth: circuit breaker for backend %s is now %s", c.name, breakerStates[state])
+	c.state = state
+	breakerState.WithLabelValues(c.name).Set(float64(state))
+	breakerTransitions.WithLabelValues(c.name, breakerStates[state]).Inc()
+}
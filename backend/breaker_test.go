@@ -0,0 +1,162 @@
+package backend_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+type checkedBackend struct {
+	mu      sync.Mutex
+	healthy bool
+}
+
+func (c *checkedBackend) Authenticate(r *http.Request) (bool, error) {
+	if err := c.HealthCheck(r.Context()); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *checkedBackend) HealthCheck(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.healthy {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (c *checkedBackend) set(healthy bool) {
+	c.mu.Lock()
+	c.healthy = healthy
+	c.mu.Unlock()
+}
+
+func TestBreaker(t *testing.T) {
+	counter := &countingBackend{err: errors.New("unavailable")}
+	breaker := backend.NewBreaker(counter, "test", 2, 20*time.Millisecond)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "secret")
+
+	t.Log("Testing the breaker opens after consecutive errors")
+	for i := 0; i < 2; i++ {
+		if _, err := breaker.Authenticate(r); err != counter.err {
+			t.Errorf("Expected %v got %v", counter.err, err)
+		}
+	}
+	if breaker.State() != backend.BreakerOpen {
+		t.Fatalf("Expected the breaker to be open, got %d", breaker.State())
+	}
+
+	t.Log("Testing the breaker fails fast while open")
+	if _, err := breaker.Authenticate(r); err != backend.ErrBreakerOpen {
+		t.Errorf("Expected %v got %v", backend.ErrBreakerOpen, err)
+	}
+	if counter.calls != 2 {
+		t.Errorf("Expected the backend to be called twice, got %d", counter.calls)
+	}
+
+	t.Log("Testing a failed trial reopens the breaker")
+	time.Sleep(30 * time.Millisecond)
+	if _, err := breaker.Authenticate(r); err != counter.err {
+		t.Errorf("Expected %v got %v", counter.err, err)
+	}
+	if breaker.State() != backend.BreakerOpen {
+		t.Errorf("Expected the breaker to be open, got %d", breaker.State())
+	}
+
+	t.Log("Testing a successful trial closes the breaker")
+	counter.err = nil
+	time.Sleep(30 * time.Millisecond)
+	if ok, err := breaker.Authenticate(r); !ok || err != nil {
+		t.Errorf("Expected success got %v (%v)", ok, err)
+	}
+	if breaker.State() != backend.BreakerClosed {
+		t.Errorf("Expected the breaker to be closed, got %d", breaker.State())
+	}
+}
+
+func TestBreakerAbandonedTrial(t *testing.T) {
+	counter := &countingBackend{err: errors.New("unavailable")}
+	breaker := backend.NewBreaker(counter, "test-abandoned", 1, 20*time.Millisecond)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "secret")
+
+	if _, err := breaker.Authenticate(r); err != counter.err {
+		t.Errorf("Expected %v got %v", counter.err, err)
+	}
+
+	t.Log("Testing a cancelled trial reopens the breaker")
+	time.Sleep(30 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := breaker.AuthenticateContext(ctx, r.WithContext(ctx)); err != context.Canceled {
+		t.Errorf("Expected %v got %v", context.Canceled, err)
+	}
+	if breaker.State() != backend.BreakerOpen {
+		t.Errorf("Expected the breaker to be open, got %d", breaker.State())
+	}
+
+	t.Log("Testing another trial is allowed after the interval")
+	counter.err = nil
+	time.Sleep(30 * time.Millisecond)
+	if ok, err := breaker.Authenticate(r); !ok || err != nil {
+		t.Errorf("Expected success got %v (%v)", ok, err)
+	}
+	if breaker.State() != backend.BreakerClosed {
+		t.Errorf("Expected the breaker to be closed, got %d", breaker.State())
+	}
+}
+
+func TestBreakerHealthCheck(t *testing.T) {
+	checked := &checkedBackend{}
+	breaker := backend.NewBreaker(checked, "test-health", 1, 10*time.Millisecond)
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	breaker.Authenticate(r)
+	if breaker.State() != backend.BreakerOpen {
+		t.Fatalf("Expected the breaker to be open, got %d", breaker.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, err := breaker.Authenticate(r); err != backend.ErrBreakerOpen {
+		t.Errorf("Expected requests to fail fast while unhealthy, got %v", err)
+	}
+
+	checked.set(true)
+	deadline := time.Now().Add(time.Second)
+	for breaker.State() != backend.BreakerClosed && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if breaker.State() != backend.BreakerClosed {
+		t.Fatal("Expected the health check to close the breaker")
+	}
+
+	if ok, err := breaker.Authenticate(r); !ok || err != nil {
+		t.Errorf("Expected success got %v (%v)", ok, err)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	}))
+
+	if err := backend.CheckURL(context.Background(), srv.URL, time.Second, false); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	srv.Close()
+	if err := backend.CheckURL(context.Background(), srv.URL, time.Second, false); err == nil {
+		t.Error("Expected an error, didn't get one")
+	}
+}
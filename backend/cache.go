@@ -0,0 +1,225 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package backend
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the default maximum number of cached results
+const DefaultCacheSize = 10000
+
+// Cache wraps a backend caching authentication results keyed on a salted hash
+// of the credentials presented with the request. Errors are never cached.
+type Cache struct {
+	backend     Backend
+	ttl         time.Duration
+	negativeTTL time.Duration
+	max         int
+	salt        []byte
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	key      string
+	identity *Identity
+	expires  time.Time
+}
+
+// ErrUncacheable is returned when asked to cache a backend whose results
+// can't be cached
+var ErrUncacheable = errors.New("results of this backend can't be cached")
+
+// Uncacheable is implemented by backends whose results depend on more than
+// the credentials presented with the request, such as the client's address,
+// cached results would be handed to the wrong clients.
+type Uncacheable interface {
+	Backend
+	Uncacheable()
+}
+
+// IsUncacheable reports whether the results of the backend, or the one behind
+// its breaker, depend on more than the credentials presented
+func IsUncacheable(b Backend) bool {
+	if breaker, ok := b.(*Breaker); ok {
+		b = breaker.backend
+	}
+	_, ok := b.(Uncacheable)
+	return ok
+}
+
+// NewCache returns a backend caching successful authentications for ttl and
+// failed authentications for negativeTTL, up to max entries in total.
+func NewCache(b Backend, ttl, negativeTTL time.Duration, max int) (*Cache, error) {
+	if IsUncacheable(b) {
+		return nil, ErrUncacheable
+	}
+
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	if max <= 0 {
+		max = DefaultCacheSize
+	}
+
+	return &Cache{
+		backend:     b,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		max:         max,
+		salt:        salt,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+	}, nil
+}
+
+// Authenticate fulfils the backend interface
+func (c *Cache) Authenticate(r *http.Request) (bool, error) {
+	id, err := c.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (c *Cache) AuthenticateIdentity(r *http.Request) (*Identity, error) {
+	return c.AuthenticateContext(r.Context(), r)
+}
+
+// AuthenticateContext fulfils the context backend interface
+func (c *Cache) AuthenticateContext(ctx context.Context, r *http.Request) (*Identity, error) {
+	key, ok := c.key(r)
+	if !ok {
+		return IdentifyContext(ctx, c.backend, r)
+	}
+
+	if id, found := c.get(key); found {
+		return id, nil
+	}
+
+	id, err := IdentifyContext(ctx, c.backend, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if id != nil {
+		c.set(key, id, c.ttl)
+	} else if c.negativeTTL > 0 {
+		c.set(key, nil, c.negativeTTL)
+	}
+
+	return id, nil
+}
+
+// Purge removes every cached result for the named user
+func (c *Cache) Purge(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if ce := e.Value.(*cacheEntry); ce.identity != nil && ce.identity.Username == username {
+			c.remove(e)
+		}
+		e = next
+	}
+}
+
+// Len returns the number of cached results
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// key derives the cache key from the credentials in the request, requests
+// without any credentials aren't cached
+func (c *Cache) key(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	cookies := r.Header.Get("Cookie")
+	if auth == "" && cookies == "" {
+		return "", false
+	}
+
+	mac := hmac.New(sha256.New, c.salt)
+	mac.Write([]byte(auth))
+	mac.Write([]byte{0})
+	mac.Write([]byte(cookies))
+	return string(mac.Sum(nil)), true
+}
+
+func (c *Cache) get(key string) (*Identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+
+	ce := e.Value.(*cacheEntry)
+	if time.Now().After(ce.expires) {
+		c.remove(e)
+		return nil, false
+	}
+
+	c.order.MoveToFront(e)
+	return ce.identity, true
+}
+
+func (c *Cache) set(key string, id *Identity, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, found := c.entries[key]; found {
+		c.remove(e)
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{
+		key:      key,
+		identity: id,
+		expires:  time.Now().Add(ttl),
+	})
+
+	for c.order.Len() > c.max {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Cache) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
@@ -0,0 +1,138 @@
+package backend_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+type countingBackend struct {
+	calls int
+	err   error
+}
+
+func (c *countingBackend) Authenticate(r *http.Request) (bool, error) {
+	id, err := c.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+func (c *countingBackend) AuthenticateIdentity(r *http.Request) (*backend.Identity, error) {
+	c.calls++
+	un, pw, _ := r.BasicAuth()
+	if pw != "secret" || c.err != nil {
+		return nil, c.err
+	}
+	return &backend.Identity{Username: un}, nil
+}
+
+func TestCache(t *testing.T) {
+	counter := &countingBackend{}
+	cache, err := backend.NewCache(counter, time.Minute, 0, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	request := func(un, pw string) *http.Request {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if un != "" {
+			r.SetBasicAuth(un, pw)
+		}
+		return r
+	}
+
+	authenticate := func(r *http.Request, expect bool, calls int) {
+		t.Helper()
+		ok, err := cache.Authenticate(r)
+		if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if ok != expect {
+			t.Errorf("Expected %v got %v", expect, ok)
+		}
+		if counter.calls != calls {
+			t.Errorf("Expected %d calls got %d", calls, counter.calls)
+		}
+	}
+
+	t.Log("Testing successful authentication is cached")
+	authenticate(request("bob", "secret"), true, 1)
+	authenticate(request("bob", "secret"), true, 1)
+
+	t.Log("Testing failed authentication isn't cached without a negative ttl")
+	authenticate(request("bob", "wrong"), false, 2)
+	authenticate(request("bob", "wrong"), false, 3)
+
+	t.Log("Testing requests without credentials aren't cached")
+	authenticate(request("", ""), false, 4)
+	authenticate(request("", ""), false, 5)
+	if got := cache.Len(); got != 1 {
+		t.Errorf("Expected 1 entry got %d", got)
+	}
+
+	t.Log("Testing the oldest entries are evicted")
+	authenticate(request("alice", "secret"), true, 6)
+	authenticate(request("fred", "secret"), true, 7)
+	if got := cache.Len(); got != 2 {
+		t.Errorf("Expected 2 entries got %d", got)
+	}
+	authenticate(request("bob", "secret"), true, 8)
+
+	t.Log("Testing purge")
+	cache.Purge("bob")
+	authenticate(request("bob", "secret"), true, 9)
+
+	t.Log("Testing errors aren't cached")
+	counter.err = errors.New("broken")
+	if _, err := cache.Authenticate(request("jane", "secret")); err == nil {
+		t.Error("Expected an error")
+	}
+	counter.err = nil
+	authenticate(request("jane", "secret"), true, 11)
+}
+
+func TestCacheExpiry(t *testing.T) {
+	counter := &countingBackend{}
+	cache, err := backend.NewCache(counter, 10*time.Millisecond, 10*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("bob", "wrong")
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := cache.Authenticate(r); ok {
+			t.Error("Authenticate should have failed")
+		}
+	}
+	if counter.calls != 1 {
+		t.Errorf("Expected the negative result to be cached, got %d calls", counter.calls)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	cache.Authenticate(r)
+	if counter.calls != 2 {
+		t.Errorf("Expected the negative result to expire, got %d calls", counter.calls)
+	}
+}
+
+type clientBackend struct{}
+
+func (clientBackend) Authenticate(r *http.Request) (bool, error) {
+	return r.RemoteAddr == "10.0.0.1:1234", nil
+}
+
+func (clientBackend) Uncacheable() {}
+
+func TestCacheUncacheable(t *testing.T) {
+	if _, err := backend.NewCache(clientBackend{}, time.Minute, 0, 0); err != backend.ErrUncacheable {
+		t.Errorf("Expected %v got %v", backend.ErrUncacheable, err)
+	}
+	breaker := backend.NewBreaker(clientBackend{}, "test-uncacheable", 1, time.Minute)
+	if _, err := backend.NewCache(breaker, time.Minute, 0, 0); err != backend.ErrUncacheable {
+		t.Errorf("Expected %v got %v", backend.ErrUncacheable, err)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package backend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultReloadInterval is how often watched files are checked for changes
+const DefaultReloadInterval = 5 * time.Second
+
+// ParseFunc parses the contents of a watched file
+type ParseFunc func(data []byte) (interface{}, error)
+
+// WatchedFile holds the parsed contents of a file and reloads them when the
+// file changes. The file is checked at most once per interval while its
+// contents are in use and only parsed again when its checksum changes.
+// Contents that fail to parse are rejected and the previous contents stay in
+// use until the file is fixed.
+type WatchedFile struct {
+	path     string
+	interval time.Duration
+	parse    ParseFunc
+
+	current  atomic.Value // *fileContents
+	checked  int64        // unix nanoseconds
+	checking int32
+
+	mu      sync.Mutex
+	lastErr string
+}
+
+type fileContents struct {
+	sum   [sha256.Size]byte
+	value interface{}
+}
+
+// WatchFile loads and parses the file, returning an error if it can't
+func WatchFile(path string, interval time.Duration, parse ParseFunc) (*WatchedFile, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+
+	f := &WatchedFile{
+		path:     path,
+		interval: interval,
+		parse:    parse,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	f.current.Store(&fileContents{sum: sha256.Sum256(data), value: v})
+	atomic.StoreInt64(&f.checked, time.Now().UnixNano())
+
+	return f, nil
+}
+
+// Load returns the parsed contents of the file, checking the file for
+// changes in the background if it hasn't been checked for an interval
+func (f *WatchedFile) Load() interface{} {
+	if time.Since(time.Unix(0, atomic.LoadInt64(&f.checked))) >= f.interval && atomic.CompareAndSwapInt32(&f.checking, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&f.checking, 0)
+			f.check()
+		}()
+	}
+	return f.current.Load().(*fileContents).value
+}
+
+// Reload reads the file and swaps in its contents if they changed and can be
+// parsed, otherwise the previous contents are kept and the error returned
+func (f *WatchedFile) Reload() (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	atomic.StoreInt64(&f.checked, time.Now().UnixNano())
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256(data)
+	if bytes.Equal(sum[:], f.current.Load().(*fileContents).sum[:]) {
+		return false, nil
+	}
+
+	v, err := f.parse(data)
+	if err != nil {
+		return false, fmt.Errorf("unable to parse %s: %v", f.path, err)
+	}
+
+	f.current.Store(&fileContents{sum: sum, value: v})
+	return true, nil
+}
+
+// check reloads the file, logging the outcome. The same error is only
+// logged once so a broken file doesn't flood the log.
+func (f *WatchedFile) check() {
+	reloaded, err := f.Reload()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case err != nil:
+		if err.Error() != f.lastErr {
+			log.Printf("[ERROR] reauth: keeping the previous contents of %s: %v", f.path, err)
+		}
+		f.lastErr = err.Error()
+	case reloaded:
+		log.Printf("[INFO] reauth: reloaded %s", f.path)
+		f.lastErr = ""
+	default:
+		f.lastErr = ""
+	}
+}
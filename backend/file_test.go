@@ -0,0 +1,129 @@
+package backend_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+func parseLines(data []byte) (interface{}, error) {
+	s := strings.TrimSpace(string(data))
+	if s == "" {
+		return nil, errors.New("empty")
+	}
+	return strings.Split(s, "\n"), nil
+}
+
+func TestWatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "users")
+	write := func(s string) {
+		if err := ioutil.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := backend.WatchFile(path, time.Hour, parseLines); err == nil {
+		t.Error("Expected an error for a missing file, didn't get one")
+	}
+
+	write("")
+	if _, err := backend.WatchFile(path, time.Hour, parseLines); err == nil {
+		t.Error("Expected an error for invalid contents, didn't get one")
+	}
+
+	write("a\nb")
+	f, err := backend.WatchFile(path, time.Hour, parseLines)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	expect := func(n int) {
+		t.Helper()
+		if got := f.Load().([]string); len(got) != n {
+			t.Errorf("Expected %d lines got %v", n, got)
+		}
+	}
+
+	t.Log("Testing unchanged file")
+	if reloaded, err := f.Reload(); reloaded || err != nil {
+		t.Errorf("Expected no reload, got %v `%v`", reloaded, err)
+	}
+	expect(2)
+
+	t.Log("Testing changed file")
+	write("a\nb\nc")
+	if reloaded, err := f.Reload(); !reloaded || err != nil {
+		t.Errorf("Expected a reload, got %v `%v`", reloaded, err)
+	}
+	expect(3)
+
+	t.Log("Testing invalid file")
+	write("   ")
+	if reloaded, err := f.Reload(); reloaded || err == nil {
+		t.Errorf("Expected the contents to be rejected, got %v `%v`", reloaded, err)
+	}
+	expect(3)
+
+	t.Log("Testing removed file")
+	os.Remove(path)
+	if reloaded, err := f.Reload(); reloaded || err == nil {
+		t.Errorf("Expected an error, got %v `%v`", reloaded, err)
+	}
+	expect(3)
+}
+
+func TestWatchFilePolling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(path, []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := backend.WatchFile(path, 10*time.Millisecond, parseLines)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("a\nb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hammer the file from several goroutines while it is reloaded
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(2 * time.Second)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if len(f.Load().([]string)) == 2 {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := f.Load().([]string); len(got) != 2 {
+		t.Errorf("Expected the file to be reloaded, got %v", got)
+	}
+}
@@ -0,0 +1,147 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package backend
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseNetworks parses a comma separated list of CIDR networks or addresses,
+// addresses are treated as networks of a single host
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, n := range strings.Split(s, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		if !strings.Contains(n, "/") {
+			if ip := net.ParseIP(n); ip != nil && ip.To4() != nil {
+				n += "/32"
+			} else {
+				n += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, ipnet)
+	}
+	return networks, nil
+}
+
+// ContainsIP returns true if any of the networks contain the ip
+func ContainsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Forwarding headers that can be believed when they come from trusted
+// proxies, only one is ever looked at so a client can't supply the one the
+// proxy doesn't set
+const (
+	XForwardedFor = "x-forwarded-for"
+	Forwarded     = "forwarded"
+
+	DefaultForwardedHeader = XForwardedFor
+)
+
+// ParseForwardedHeader validates the name of a forwarding header
+func ParseForwardedHeader(s string) (string, error) {
+	switch h := strings.ToLower(s); h {
+	case XForwardedFor, Forwarded:
+		return h, nil
+	}
+	return "", fmt.Errorf("unknown forwarded header %s", s)
+}
+
+// ClientIP returns the address of the client that made the request.
+// The forwarding header is only believed when the request came from one of
+// the trusted proxies, in which case the hops are walked from the nearest
+// until one that isn't a trusted proxy is found.
+// A nil ip is returned if the address can't be determined.
+func ClientIP(r *http.Request, trusted []*net.IPNet, header string) net.IP {
+	ip := parseHop(r.RemoteAddr)
+	if ip == nil || !ContainsIP(trusted, ip) {
+		return ip
+	}
+
+	hops := forwardedFor(r.Header, header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			return nil
+		}
+		ip = hop
+		if !ContainsIP(trusted, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedFor returns the client addresses from the given forwarding
+// header in the order the proxies added them
+func forwardedFor(h http.Header, header string) []string {
+	var hops []string
+
+	if header == Forwarded {
+		for _, v := range h["Forwarded"] {
+			for _, element := range strings.Split(v, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+					if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+						hops = append(hops, strings.Trim(kv[1], `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, v := range h["X-Forwarded-For"] {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address that may carry a port and, for ipv6, brackets
+func parseHop(s string) net.IP {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
@@ -0,0 +1,120 @@
+package backend_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := backend.ParseNetworks("10.0.0.0/8, 192.168.1.1,,::1")
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	expect := []string{"10.0.0.0/8", "192.168.1.1/32", "::1/128"}
+	if len(networks) != len(expect) {
+		t.Fatalf("Expected %v got %v", expect, networks)
+	}
+	for i, n := range networks {
+		if n.String() != expect[i] {
+			t.Errorf("Expected %v got %v", expect[i], n)
+		}
+	}
+
+	if _, err := backend.ParseNetworks("10.0.0.0/33"); err == nil {
+		t.Error("Expected an error, didn't get one")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := backend.ParseNetworks("10.0.0.0/8,fd00::/8")
+
+	tests := []struct {
+		desc    string
+		remote  string
+		header  string
+		headers map[string]string
+		expect  string
+	}{{
+		desc:   "direct client",
+		remote: "203.0.113.1:1234",
+		expect: "203.0.113.1",
+	}, {
+		desc:    "forwarded for by an untrusted client",
+		remote:  "203.0.113.1:1234",
+		headers: map[string]string{"X-Forwarded-For": "10.1.1.1"},
+		expect:  "203.0.113.1",
+	}, {
+		desc:    "x-forwarded-for from a trusted proxy",
+		remote:  "10.0.0.1:1234",
+		headers: map[string]string{"X-Forwarded-For": "198.51.100.7, 203.0.113.1, 10.0.0.2"},
+		expect:  "203.0.113.1",
+	}, {
+		desc:    "forwarded from a trusted proxy",
+		remote:  "10.0.0.1:1234",
+		header:  backend.Forwarded,
+		headers: map[string]string{"Forwarded": `for=198.51.100.7;proto=https, for="[2001:db8::1]:4711"`, "X-Forwarded-For": "10.2.2.2"},
+		expect:  "2001:db8::1",
+	}, {
+		desc:    "forwarded passed through by an x-forwarded-for proxy",
+		remote:  "10.0.0.1:1234",
+		headers: map[string]string{"Forwarded": "for=10.0.0.5", "X-Forwarded-For": "10.0.0.5, 203.0.113.9"},
+		expect:  "203.0.113.9",
+	}, {
+		desc:    "x-forwarded-for passed through by a forwarded proxy",
+		remote:  "10.0.0.1:1234",
+		header:  backend.Forwarded,
+		headers: map[string]string{"Forwarded": "for=203.0.113.9", "X-Forwarded-For": "10.0.0.5"},
+		expect:  "203.0.113.9",
+	}, {
+		desc:    "forwarded proxy without forwarded header",
+		remote:  "10.0.0.1:1234",
+		header:  backend.Forwarded,
+		headers: map[string]string{"X-Forwarded-For": "10.0.0.5"},
+		expect:  "10.0.0.1",
+	}, {
+		desc:    "every hop trusted",
+		remote:  "[fd00::1]:1234",
+		headers: map[string]string{"X-Forwarded-For": "10.0.0.3"},
+		expect:  "10.0.0.3",
+	}, {
+		desc:   "trusted proxy without forwarding headers",
+		remote: "10.0.0.1:1234",
+		expect: "10.0.0.1",
+	}, {
+		desc:    "obfuscated hop",
+		remote:  "10.0.0.1:1234",
+		header:  backend.Forwarded,
+		headers: map[string]string{"Forwarded": "for=unknown"},
+		expect:  "<nil>",
+	}}
+
+	for i, tc := range tests {
+		t.Logf("Testing client ip %d (%s)", i+1, tc.desc)
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			r.Header.Set(k, v)
+		}
+		header := tc.header
+		if header == "" {
+			header = backend.DefaultForwardedHeader
+		}
+		if got := backend.ClientIP(r, trusted, header).String(); got != tc.expect {
+			t.Errorf("Expected %v got %v", tc.expect, got)
+		}
+	}
+}
+
+func TestParseForwardedHeader(t *testing.T) {
+	for s, expect := range map[string]string{"X-Forwarded-For": backend.XForwardedFor, "forwarded": backend.Forwarded} {
+		if h, err := backend.ParseForwardedHeader(s); err != nil || h != expect {
+			t.Errorf("Expected %v got %v `%v`", expect, h, err)
+		}
+	}
+	if _, err := backend.ParseForwardedHeader("x-real-ip"); err == nil {
+		t.Error("Expected an error, didn't get one")
+	}
+}
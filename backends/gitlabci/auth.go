@@ -25,6 +25,7 @@
 package gitlabci
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -119,16 +120,27 @@ func noRedirectsPolicy(req *http.Request, via []*http.Request) error {
 
 // Authenticate fulfils the backend interface
 func (h GitlabCI) Authenticate(r *http.Request) (bool, error) {
+	id, err := h.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface, the identity is
+// the project path
+func (h GitlabCI) AuthenticateIdentity(r *http.Request) (*backend.Identity, error) {
+	return h.AuthenticateContext(r.Context(), r)
+}
+
+// AuthenticateContext fulfils the context backend interface, the request to
+// gitlab is abandoned once the context is done
+func (h GitlabCI) AuthenticateContext(ctx context.Context, r *http.Request) (*backend.Identity, error) {
 	un, pw, k := r.BasicAuth()
 	if !k {
-		return false, nil
+		return nil, nil
 	}
 
-	un += ".git/info/refs?service=git-upload-pack"
-
-	repo, err := h.url.Parse(un)
+	repo, err := h.url.Parse(un + ".git/info/refs?service=git-upload-pack")
 	if err != nil {
-		return false, nil
+		return nil, nil
 	}
 
 	c := &http.Client{
@@ -144,20 +156,25 @@ func (h GitlabCI) Authenticate(r *http.Request) (bool, error) {
 
 	req, err := http.NewRequest("GET", repo.String(), nil)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	req.SetBasicAuth(h.username, pw)
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
-		return false, nil
+		return nil, nil
 	}
 
-	return true, nil
+	return &backend.Identity{Username: un}, nil
+}
 
+// HealthCheck fulfils the health checker interface
+func (h GitlabCI) HealthCheck(ctx context.Context) error {
+	return backend.CheckURL(ctx, h.url.String(), h.timeout, h.insecureSkipVerify)
 }
@@ -0,0 +1,180 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package ip
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// Backend name
+const Backend = "ip"
+
+// IP backend accepts requests from clients within the allowed networks,
+// forwarding headers are only believed when they come from trusted proxies.
+// Allowed networks may also be listed in a file that is reloaded when it
+// changes.
+type IP struct {
+	allow     []*net.IPNet
+	proxies   []*net.IPNet
+	header    string
+	allowFile *backend.WatchedFile
+}
+
+func init() {
+	err := backend.Register(Backend, constructor)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func constructor(config string) (backend.Backend, error) {
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &IP{header: backend.DefaultForwardedHeader}
+	interval := backend.DefaultReloadInterval
+
+	if s, found := options["reload"]; found {
+		if interval, err = time.ParseDuration(s); err != nil {
+			return nil, fmt.Errorf("unable to parse reload %s: %v", s, err)
+		}
+		if interval <= 0 {
+			return nil, errors.New("reload must be positive")
+		}
+	}
+
+	for k, v := range options {
+		switch k {
+		case "reload":
+			if _, found := options["allow_file"]; !found {
+				return nil, errors.New("reload requires allow_file")
+			}
+		case "allow_file":
+			if h.allowFile, err = backend.WatchFile(v, interval, parseFile); err != nil {
+				return nil, err
+			}
+		case "allow":
+			if h.allow, err = backend.ParseNetworks(v); err != nil {
+				return nil, fmt.Errorf("unable to parse allow %s: %v", v, err)
+			}
+		case "trusted_proxies":
+			if h.proxies, err = backend.ParseNetworks(v); err != nil {
+				return nil, fmt.Errorf("unable to parse trusted_proxies %s: %v", v, err)
+			}
+		case "forwarded_header":
+			if h.header, err = backend.ParseForwardedHeader(v); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %v", k)
+		}
+	}
+
+	if len(h.allow) == 0 && h.allowFile == nil {
+		return nil, errors.New("allow or allow_file is a required parameter")
+	}
+
+	return h, nil
+}
+
+// parseFile parses networks or addresses, one or more per line, blank lines
+// and lines starting with # are ignored
+func parseFile(data []byte) (interface{}, error) {
+	var networks []*net.IPNet
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parsed, err := backend.ParseNetworks(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		networks = append(networks, parsed...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// An empty file is more likely to be half written than intended
+	if len(networks) == 0 {
+		return nil, errors.New("no networks found")
+	}
+
+	return networks, nil
+}
+
+// allowed returns true if the ip is within one of the allowed networks
+func (h IP) allowed(ip net.IP) bool {
+	if backend.ContainsIP(h.allow, ip) {
+		return true
+	}
+	return h.allowFile != nil && backend.ContainsIP(h.allowFile.Load().([]*net.IPNet), ip)
+}
+
+// Authenticate fulfils the backend interface
+func (h IP) Authenticate(r *http.Request) (bool, error) {
+	id, err := h.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface, the identity
+// has no username so one reported by another backend of the rule wins, the
+// client address is reported as the client_ip claim
+func (h IP) AuthenticateIdentity(r *http.Request) (*backend.Identity, error) {
+	ip := backend.ClientIP(r, h.proxies, h.header)
+	if ip == nil || !h.allowed(ip) {
+		return nil, nil
+	}
+
+	return &backend.Identity{Claims: map[string]string{"client_ip": ip.String()}}, nil
+}
+
+// Uncacheable marks the backend's results as depending on the client rather
+// than its credentials
+func (h IP) Uncacheable() {}
+
+// AuthenticateContext fulfils the context backend interface
+func (h IP) AuthenticateContext(ctx context.Context, r *http.Request) (*backend.Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return h.AuthenticateIdentity(r)
+}
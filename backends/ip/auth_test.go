@@ -0,0 +1,174 @@
+package ip
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	be, err := constructor(`allow="10.0.0.0/8,192.168.0.0/16",trusted_proxies=172.16.0.1`)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+	auth := be.(*IP)
+
+	tests := []struct {
+		desc   string
+		remote string
+		xff    string
+		expect string
+	}{
+		{`Allowed client`, `10.1.2.3:1234`, ``, `10.1.2.3`},
+		{`Denied client`, `203.0.113.1:1234`, ``, ``},
+		{`Spoofed forwarding header`, `203.0.113.1:1234`, `10.1.2.3`, ``},
+		{`Allowed client behind trusted proxy`, `172.16.0.1:1234`, `192.168.4.4`, `192.168.4.4`},
+		{`Denied client behind trusted proxy`, `172.16.0.1:1234`, `203.0.113.1`, ``},
+		{`Spoofed hop behind trusted proxy`, `172.16.0.1:1234`, `10.1.2.3, 203.0.113.1`, ``},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing request %d (%s)", i+1, tc.desc)
+		r, _ := http.NewRequest("GET", "https://test.example.com", nil)
+		r.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			r.Header.Set("X-Forwarded-For", tc.xff)
+		}
+
+		id, err := auth.AuthenticateIdentity(r)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		switch {
+		case tc.expect == "" && id != nil:
+			t.Errorf("Authenticate should have failed, got %v", id)
+		case tc.expect != "" && id == nil:
+			t.Error("Authenticate should have succeeded")
+		case id != nil && (id.Username != "" || id.Claims["client_ip"] != tc.expect):
+			t.Errorf("Expected anonymous identity for %s, got %v", tc.expect, id)
+		}
+	}
+}
+
+func TestAuthenticateForwardedSpoof(t *testing.T) {
+	r, _ := http.NewRequest("GET", "https://test.example.com", nil)
+	r.RemoteAddr = "192.168.1.1:1234"
+	r.Header.Set("Forwarded", "for=10.0.0.5")
+	r.Header.Set("X-Forwarded-For", "10.0.0.5, 203.0.113.9")
+
+	for config, expect := range map[string]bool{
+		`allow=10.0.0.0/8,trusted_proxies=192.168.1.1`:                                  false,
+		`allow=10.0.0.0/8,trusted_proxies=192.168.1.1,forwarded_header=x-forwarded-for`: false,
+		`allow=10.0.0.0/8,trusted_proxies=192.168.1.1,forwarded_header=forwarded`:       true,
+	} {
+		be, err := constructor(config)
+		if err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+		ok, err := be.Authenticate(r)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if ok != expect {
+			t.Errorf("Expected %v with %s got %v", expect, config, ok)
+		}
+	}
+}
+
+func TestAuthenticateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "allow")
+	if err := ioutil.WriteFile(path, []byte("# office\n10.0.0.0/8\n\n192.168.1.1, 192.168.1.2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	be, err := constructor("allow=172.16.0.0/12,allow_file=" + path + ",reload=1h")
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+	auth := be.(*IP)
+
+	check := func(remote string, expect bool) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", "https://test.example.com", nil)
+		r.RemoteAddr = remote + ":1234"
+		ok, err := auth.Authenticate(r)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if ok != expect {
+			t.Errorf("Expected %v for %s got %v", expect, remote, ok)
+		}
+	}
+
+	check("10.1.2.3", true)
+	check("192.168.1.2", true)
+	check("192.168.1.3", false)
+	check("172.16.1.1", true)
+
+	t.Log("Testing changed file")
+	if err := ioutil.WriteFile(path, []byte("192.168.1.3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.allowFile.Reload(); err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+	check("10.1.2.3", false)
+	check("192.168.1.3", true)
+	check("172.16.1.1", true)
+
+	t.Log("Testing invalid file")
+	if err := ioutil.WriteFile(path, []byte("192.168.1.300\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.allowFile.Reload(); err == nil {
+		t.Error("Expected an error, didn't get one")
+	}
+	check("192.168.1.3", true)
+}
+
+func TestAuthenticateConstructor(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config string
+		err    error
+	}{
+		{`Empty configuration`, ``, errors.New(`Unable to parse options string, missing pair`)},
+		{`Allow only`, `allow=10.0.0.0/8`, nil},
+		{`Allow list with proxies`, `allow="10.0.0.0/8,::1",trusted_proxies="127.0.0.1,::1"`, nil},
+		{`Missing allow`, `trusted_proxies=127.0.0.1`, errors.New(`allow or allow_file is a required parameter`)},
+		{`Invalid allow`, `allow=10.0.0.0/99`, errors.New(`unable to parse allow 10.0.0.0/99: invalid CIDR address: 10.0.0.0/99`)},
+		{`Invalid trusted_proxies`, `allow=10.0.0.0/8,trusted_proxies=nope`, errors.New(`unable to parse trusted_proxies nope: invalid CIDR address: nope/128`)},
+		{`Unknown option`, `allow=10.0.0.0/8,deny=10.0.0.1`, errors.New(`unknown option deny`)},
+		{`Forwarded header`, `allow=10.0.0.0/8,forwarded_header=Forwarded`, nil},
+		{`Unknown forwarded header`, `allow=10.0.0.0/8,forwarded_header=x-real-ip`, errors.New(`unknown forwarded header x-real-ip`)},
+		{`Reload without file`, `allow=10.0.0.0/8,reload=5s`, errors.New(`reload requires allow_file`)},
+		{`Invalid reload`, `allow=10.0.0.0/8,reload=-5s`, errors.New(`reload must be positive`)},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing configuration %d (%s)", i+1, tc.desc)
+		be, err := constructor(tc.config)
+		if tc.err != nil {
+			if err == nil {
+				t.Error("Expected error, got none")
+			} else if err.Error() != tc.err.Error() {
+				t.Errorf("Expected `%v` got `%v`", tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		} else if _, ok := be.(*IP); !ok {
+			t.Errorf("Expected *IP, got %T", be)
+		}
+	}
+}
@@ -25,6 +25,7 @@
 package ldap
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -32,9 +33,11 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/freman/caddy-reauth/backend"
+	"github.com/prometheus/client_golang/prometheus"
 
 	ldp "gopkg.in/ldap.v2"
 )
@@ -51,6 +54,9 @@ const DefaultTimeout = time.Minute
 // DefaultFilter is the defauilt LDAP filter
 const DefaultFilter = "(&(objectClass=user)(sAMAccountName=%s))"
 
+// DefaultGroupsAttribute is the attribute listing the groups a user is a member of
+const DefaultGroupsAttribute = "memberOf"
+
 // LDAP backend provides authentication against LDAP paths, for example for Microsoft AD.
 //
 type LDAP struct {
@@ -63,14 +69,24 @@ type LDAP struct {
 	tls                bool
 	insecureSkipVerify bool
 	timeout            time.Duration
+	groupsAttribute    string
+	attributes         []string
 	pool               chan ldp.Client
 }
 
+var poolConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "caddy",
+	Subsystem: "reauth",
+	Name:      "ldap_pool_connections",
+	Help:      "Idle connections in the LDAP connection pool by server.",
+}, []string{"server"})
+
 func init() {
 	err := backend.Register(Backend, constructor)
 	if err != nil {
 		panic(err)
 	}
+	prometheus.MustRegister(poolConnections)
 }
 
 func constructor(config string) (backend.Backend, error) {
@@ -82,6 +98,7 @@ func constructor(config string) (backend.Backend, error) {
 	us := &LDAP{
 		timeout:         DefaultTimeout,
 		principalSuffix: options["principal_suffix"],
+		groupsAttribute: DefaultGroupsAttribute,
 	}
 
 	s, found := options["url"]
@@ -110,6 +127,14 @@ func constructor(config string) (backend.Backend, error) {
 		us.filterDN = DefaultFilter
 	}
 
+	if s, found := options["groups"]; found {
+		us.groupsAttribute = s
+	}
+
+	if s, found := options["attributes"]; found && s != "" {
+		us.attributes = strings.Split(s, ",")
+	}
+
 	if s, found := options["insecure"]; found {
 		b, err := strconv.ParseBool(s)
 		if err != nil {
@@ -152,61 +177,165 @@ func constructor(config string) (backend.Backend, error) {
 
 // Authenticate fulfils the backend interface
 func (h *LDAP) Authenticate(r *http.Request) (bool, error) {
+	id, err := h.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface, groups are
+// the common names of the groups the user is a member of and the claims contain
+// the users dn and any additional attributes that were requested
+func (h *LDAP) AuthenticateIdentity(r *http.Request) (*backend.Identity, error) {
+	return h.AuthenticateContext(r.Context(), r)
+}
+
+// AuthenticateContext fulfils the context backend interface, the connection
+// is closed to abandon the search or bind in progress once the context is done
+func (h *LDAP) AuthenticateContext(ctx context.Context, r *http.Request) (*backend.Identity, error) {
 	un, pw, k := r.BasicAuth()
 	if !k {
-		return false, nil
+		return nil, nil
 	}
 
-	l, err := h.getConnection()
+	l, err := h.getConnection(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+
+	release := closeOnDone(ctx, l)
+	defer func() {
+		if release() {
+			h.stashConnection(l)
+		}
+	}()
+
+	attributes := []string{"dn"}
+	if h.groupsAttribute != "" {
+		attributes = append(attributes, h.groupsAttribute)
 	}
-	defer h.stashConnection(l)
+	attributes = append(attributes, h.attributes...)
 
 	// Search for the given username
 	searchRequest := ldp.NewSearchRequest(
 		h.baseDN,
 		ldp.ScopeWholeSubtree, ldp.NeverDerefAliases, 0, int(h.timeout/time.Second), false,
 		fmt.Sprintf(h.filterDN, un+h.principalSuffix),
-		[]string{"dn"},
+		attributes,
 		nil,
 	)
 
 	sr, err := l.Search(searchRequest)
 	if err != nil {
-		return false, fmt.Errorf("search under %q for %q: %v", h.baseDN, fmt.Sprintf(h.filterDN, un+h.principalSuffix), err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("search under %q for %q: %v", h.baseDN, fmt.Sprintf(h.filterDN, un+h.principalSuffix), err)
 	}
 
 	if len(sr.Entries) == 0 {
-		return false, nil // user does not exist
+		return nil, nil // user does not exist
 	}
 
 	if len(sr.Entries) > 1 {
-		return false, fmt.Errorf("too many entries returned")
+		return nil, fmt.Errorf("too many entries returned")
 	}
 
-	userDN := sr.Entries[0].DN
+	entry := sr.Entries[0]
+	userDN := entry.DN
 
 	// Bind as the user to verify their password
 	err = l.Bind(userDN, pw)
 	if err != nil {
 		if ldp.IsErrorWithCode(err, ldp.LDAPResultInvalidCredentials) {
-			return false, nil
+			return nil, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("bind with %q: %v", userDN, err)
+	}
+
+	id := &backend.Identity{
+		Username: un,
+		Claims:   map[string]string{"dn": userDN},
+	}
+
+	if h.groupsAttribute != "" {
+		for _, g := range entry.GetAttributeValues(h.groupsAttribute) {
+			id.Groups = append(id.Groups, groupName(g))
 		}
-		return false, fmt.Errorf("bind with %q: %v", userDN, err)
 	}
 
-	return true, nil
+	for _, a := range h.attributes {
+		if v := entry.GetAttributeValue(a); v != "" {
+			id.Claims[a] = v
+		}
+	}
+
+	return id, nil
 }
 
-func (h *LDAP) getConnection() (ldp.Client, error) {
+// HealthCheck fulfils the health checker interface, connecting and binding
+// with the configured credentials within the lifetime of the context
+func (h *LDAP) HealthCheck(ctx context.Context) error {
+	l, err := h.getConnection(ctx)
+	if err != nil {
+		return err
+	}
+	h.stashConnection(l)
+	return nil
+}
+
+// closeOnDone closes the connection if the context is done before the
+// returned function is called, which reports whether the connection is still
+// usable
+func closeOnDone(ctx context.Context, l ldp.Client) func() bool {
+	if ctx.Done() == nil {
+		return func() bool { return true }
+	}
+
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return !<-closed
+	}
+}
+
+// groupName returns the value of the first relative dn of a group, typically its CN
+func groupName(dn string) string {
+	parsed, err := ldp.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// getConnection returns a bound connection from the pool or a new one, giving
+// up once the context is done
+func (h *LDAP) getConnection(ctx context.Context) (ldp.Client, error) {
 	var l ldp.Client
 	select {
 	case l = <-h.pool:
-		if err := l.Bind(h.bindDN, h.bindPassword); err == nil {
+		poolConnections.WithLabelValues(h.url.Host).Set(float64(len(h.pool)))
+		release := closeOnDone(ctx, l)
+		err := l.Bind(h.bindDN, h.bindPassword)
+		if release() && err == nil {
 			return l, nil
 		}
 		l.Close()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 	default:
 	}
 
@@ -225,28 +354,51 @@ func (h *LDAP) getConnection() (ldp.Client, error) {
 
 	hostPort := fmt.Sprintf("%s:%s", host, port)
 
-	var err error
-	if ldaps {
-		l, err = ldp.DialTLS("tcp", hostPort, &tls.Config{InsecureSkipVerify: h.insecureSkipVerify})
-	} else {
-		l, err = ldp.Dial("tcp", hostPort)
-	}
-
+	dialer := &net.Dialer{Timeout: ldp.DefaultTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", hostPort)
 	if err != nil {
 		return nil, fmt.Errorf("connect to %q: %v", hostPort, err)
 	}
 
+	if ldaps {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: h.insecureSkipVerify})
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("connect to %q: %v", hostPort, err)
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tc
+	}
+
+	c := ldp.NewConn(conn, ldaps)
+	c.Start()
+	l = c
+
+	release := closeOnDone(ctx, l)
+
 	// Technically it's not impossible to run tls over ssl... just excessive
 	if h.tls {
-		if err = l.StartTLS(&tls.Config{InsecureSkipVerify: h.insecureSkipVerify}); err != nil {
-			l.Close()
-			return nil, fmt.Errorf("StartTLS: %v", err)
+		err = l.StartTLS(&tls.Config{InsecureSkipVerify: h.insecureSkipVerify})
+		if err != nil {
+			err = fmt.Errorf("StartTLS: %v", err)
+		}
+	}
+
+	if err == nil {
+		if err = l.Bind(h.bindDN, h.bindPassword); err != nil {
+			err = fmt.Errorf("bind with %q: %v", h.bindDN, err)
 		}
 	}
 
-	if err := l.Bind(h.bindDN, h.bindPassword); err != nil {
+	if !release() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
 		l.Close()
-		return nil, fmt.Errorf("bind with %q: %v", h.bindDN, err)
+		return nil, err
 	}
 
 	return l, nil
@@ -255,6 +407,7 @@ func (h *LDAP) getConnection() (ldp.Client, error) {
 func (h *LDAP) stashConnection(l ldp.Client) {
 	select {
 	case h.pool <- l:
+		poolConnections.WithLabelValues(h.url.Host).Set(float64(len(h.pool)))
 		return
 	default:
 		l.Close()
@@ -25,10 +25,12 @@
 package refresh
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -42,6 +44,7 @@ import (
 	"github.com/allegro/bigcache"
 	"github.com/freman/caddy-reauth/backend"
 	secrets "github.com/freman/caddy-reauth/lib/caddy-secrets"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Backend name
@@ -63,17 +66,43 @@ type Refresh struct {
 	followRedirects    bool
 	passCookies        bool
 	respLimit          int64
+	userKey            string
 }
 
 var reauth yaml.MapSlice
 var reauthEndpoints []interface{}
 var endpoints []endpoint
 
+var cacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "caddy",
+	Subsystem: "reauth",
+	Name:      "refresh_cache_total",
+	Help:      "Refresh endpoint cache lookups by result (hit or miss).",
+}, []string{"result"})
+
 func init() {
 	err := backend.Register(Backend, constructor)
 	if err != nil {
 		panic(err)
 	}
+	prometheus.MustRegister(cacheLookups)
+}
+
+// resultRefresh is a Refresh that passes its result down the filter chain in
+// the request's form, skipping it would lose the result
+type resultRefresh struct {
+	*Refresh
+}
+
+// Uncacheable marks the backend's results as unfit for the cache
+func (resultRefresh) Uncacheable() {}
+
+// withResult wraps the backend when a resultkey is configured
+func withResult(rf *Refresh) backend.Backend {
+	if len(resultKey) > 0 {
+		return resultRefresh{rf}
+	}
+	return rf
 }
 
 func noRedirectsPolicy(req *http.Request, via []*http.Request) error {
@@ -115,7 +144,7 @@ func constructor(config string) (backend.Backend, error) {
 	if err = initSecretValues(); err != nil {
 		return nil, err
 	}
-	return rf, nil
+	return withResult(rf), nil
 }
 
 func setupCache(options map[string]string) (*bigcache.BigCache, error) {
@@ -166,6 +195,8 @@ func configureRefreshHandler(rf *Refresh, options map[string]string) error {
 		return err
 	}
 	rf.respLimit = ival
+
+	rf.userKey = options["userkey"]
 	return nil
 }
 
@@ -220,7 +251,7 @@ func initSecretValues() error {
 	return nil
 }
 
-func (h Refresh) refreshRequestObject(c *http.Client, requestToAuth *http.Request, e endpoint, inputMap map[string]string) ([]byte, error) {
+func (h Refresh) refreshRequestObject(ctx context.Context, c *http.Client, requestToAuth *http.Request, e endpoint, inputMap map[string]string) ([]byte, error) {
 	data := url.Values{}
 	for _, d := range e.Data {
 		data.Set(d.Key, replaceInputs(d.Value, inputMap))
@@ -229,6 +260,7 @@ func (h Refresh) refreshRequestObject(c *http.Client, requestToAuth *http.Reques
 	if err != nil {
 		return nil, err
 	}
+	endpointReq = endpointReq.WithContext(ctx)
 
 	if e.Skipverify && endpointReq.URL.Scheme == "https" && h.insecureSkipVerify {
 		c.Transport = &http.Transport{
@@ -381,54 +413,111 @@ func (h Refresh) authProcessingSetup(requestToAuth *http.Request) (map[string]st
 
 // Authenticate fulfils the backend interface
 func (h Refresh) Authenticate(requestToAuth *http.Request) (bool, error) {
+	id, err := h.AuthenticateIdentity(requestToAuth)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface, the claims are
+// the string values of the last endpoint response and the username is taken
+// from the claim named by the userkey option
+func (h Refresh) AuthenticateIdentity(requestToAuth *http.Request) (*backend.Identity, error) {
+	return h.AuthenticateContext(requestToAuth.Context(), requestToAuth)
+}
+
+// AuthenticateContext fulfils the context backend interface, the endpoint
+// chain is abandoned once the context is done
+func (h Refresh) AuthenticateContext(ctx context.Context, requestToAuth *http.Request) (*backend.Identity, error) {
 	resultsMap, c, err := h.authProcessingSetup(requestToAuth)
 	if err != nil || resultsMap == nil {
-		return failAuth(err)
+		return nil, failAuth(err)
 	}
 
 	for _, e := range endpoints {
+		if err := ctx.Err(); err != nil {
+			return nil, failAuth(err)
+		}
+
 		// check cache for saved response
 		entry, err := h.refreshCache.Get(string(resultsMap[e.Cachekey]))
 		if err != nil {
 			if err == bigcache.ErrEntryNotFound {
+				cacheLookups.WithLabelValues("miss").Inc()
 				// request data to put in cache when entry is not found
-				responseData, err := h.refreshRequestObject(c, requestToAuth, e, resultsMap)
+				responseData, err := h.refreshRequestObject(ctx, c, requestToAuth, e, resultsMap)
 				if err != nil {
 					if responseData == nil {
 						// error and empty response signal an auth fail due to server error (500)
-						return failAuth(err)
+						return nil, failAuth(err)
 
 					}
 					// error and response signal an auth fail due to unauthorized response from server
 					// Authorize returns false and no error, so that caddyfile configured response is given
 					failAuth(err)
-					return false, nil
+					return nil, nil
 
 				}
 				// nil error and response signal successful authentication
 				resultsMap[e.Name] = string(responseData)
 				err = h.refreshCache.Set(resultsMap[e.Cachekey], responseData)
 				if err != nil {
-					return failAuth(err)
+					return nil, failAuth(err)
 				}
 			} else {
 				// error different than not found cache key cause server error (500)
-				return failAuth(err)
+				return nil, failAuth(err)
 			}
 		} else {
+			cacheLookups.WithLabelValues("hit").Inc()
 			// value found in cache sets it directly to resultsMap
 			resultsMap[e.Name] = string(entry)
 		}
 	}
 
+	var result string
+	if len(endpoints) > 0 {
+		result = resultsMap[endpoints[len(endpoints)-1].Name]
+	}
+
 	if len(resultKey) > 0 {
 		if err = requestToAuth.ParseForm(); err != nil {
-			return failAuth(err)
+			return nil, failAuth(err)
 		}
-		requestToAuth.Form[resultKey] = []string{resultsMap[endpoints[len(endpoints)-1].Name]}
+		requestToAuth.Form[resultKey] = []string{result}
+	}
+
+	return h.identity(result), nil
+}
+
+// HealthCheck fulfils the health checker interface
+func (h Refresh) HealthCheck(ctx context.Context) error {
+	if h.refreshURL == "" {
+		// Every endpoint has its own url, let requests find out
+		return nil
+	}
+	return backend.CheckURL(ctx, h.refreshURL, h.timeout, h.insecureSkipVerify)
+}
+
+// identity builds an identity from the string values of a json endpoint response
+func (h Refresh) identity(result string) *backend.Identity {
+	id := &backend.Identity{}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(result), &body); err != nil {
+		return id
+	}
+
+	id.Claims = map[string]string{}
+	for k, v := range body {
+		if s, isa := v.(string); isa {
+			id.Claims[k] = s
+		}
+	}
+
+	if h.userKey != "" {
+		id.Username = id.Claims[h.userKey]
 	}
 
-	return true, nil
+	return id
 }
 
 type endpoint struct {
@@ -458,9 +547,9 @@ type dataObject struct {
 	Value string
 }
 
-func failAuth(err error) (bool, error) {
+func failAuth(err error) error {
 	if err != nil {
-		fmt.Println(err.Error())
+		log.Printf("[ERROR] reauth: refresh: %v", err)
 	}
-	return false, err
+	return err
 }
@@ -1,6 +1,7 @@
 package refresh
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/allegro/bigcache"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/freman/caddy-reauth/backend"
 	secrets "github.com/freman/caddy-reauth/lib/caddy-secrets"
 	"gopkg.in/yaml.v2"
 )
@@ -332,20 +334,20 @@ func TestRefreshRequestObject(t *testing.T) {
 	r, _ := http.NewRequest("GET", "http://test.example.com", nil)
 
 	t.Log("Testing Endpoint with unhandled method")
-	_, err := refresh.refreshRequestObject(c, r, endpoint{Method: "PUT"}, map[string]string{})
+	_, err := refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "PUT"}, map[string]string{})
 	if err == nil {
 		t.Errorf("Expected error got none")
 	}
 
 	t.Log("Testing Endpoint with GET method")
-	_, err = refresh.refreshRequestObject(c, r, endpoint{Method: "GET"}, map[string]string{})
+	_, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "GET"}, map[string]string{})
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 	}
 
 	t.Log("Testing Endpoint url used when set")
 	refresh.refreshURL = suri.String()
-	host, err := refresh.refreshRequestObject(c, r, endpoint{Method: "GET", URL: uri.String() + "/return_host"}, map[string]string{})
+	host, err := refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "GET", URL: uri.String() + "/return_host"}, map[string]string{})
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 	}
@@ -356,7 +358,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing GET Endpoint had data encoded into query string")
 	refresh.refreshURL += "/return_query"
-	query, err := refresh.refreshRequestObject(c, r, endpoint{
+	query, err := refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "GET",
 		Data:   []dataObject{dataObject{Key: "one", Value: "asdf"}, dataObject{Key: "two", Value: "fdsa"}},
 	}, map[string]string{})
@@ -369,14 +371,14 @@ func TestRefreshRequestObject(t *testing.T) {
 	refresh.refreshURL = uri.String()
 
 	t.Log("Testing Endpoint with POST method")
-	_, err = refresh.refreshRequestObject(c, r, endpoint{Method: "POST"}, map[string]string{})
+	_, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "POST"}, map[string]string{})
 	if err != nil {
 		t.Errorf("Unexpected error: %s", err.Error())
 	}
 
 	t.Log("Testing POST Endpoint had data encoded into request form")
 	refresh.refreshURL += "/return_form"
-	_, err = refresh.refreshRequestObject(c, r, endpoint{
+	_, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Data:   []dataObject{dataObject{Key: "one", Value: "asdf"}, dataObject{Key: "two", Value: "fdsa"}},
 	}, map[string]string{})
@@ -390,7 +392,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing Endpoint data replaces references with input values")
 	refresh.refreshURL += "/return_form"
-	form, err := refresh.refreshRequestObject(c, r, endpoint{
+	form, err := refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Data:   []dataObject{dataObject{Key: "one", Value: "{asdf}___{fdsa}___asdf___{fdsa}"}},
 	}, map[string]string{"asdf": "replacement-value-for-asdf", "fdsa": "replacement-for-fdsa"})
@@ -404,7 +406,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing request client transport is modified for skipverify")
 	refresh.refreshURL = suri.String()
-	refresh.refreshRequestObject(c, r, endpoint{Method: "POST", Skipverify: true}, map[string]string{})
+	refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "POST", Skipverify: true}, map[string]string{})
 	if c.Transport == nil {
 		t.Errorf("Client Transport was not set")
 	}
@@ -412,7 +414,7 @@ func TestRefreshRequestObject(t *testing.T) {
 	t.Log("Testing cookies are added to request if endpoint configured for it")
 	r.AddCookie(&http.Cookie{Name: "one", Value: "asdf"})
 	refresh.refreshURL += "/return_cookies"
-	cookies, _ := refresh.refreshRequestObject(c, r, endpoint{Method: "POST", Cookies: true}, map[string]string{})
+	cookies, _ := refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "POST", Cookies: true}, map[string]string{})
 	if !strings.Contains(string(cookies), "[one=asdf]") {
 		t.Errorf("Cookies were not added to the endpoint")
 	}
@@ -420,7 +422,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing headers are added to request if endpoint configured for it")
 	refresh.refreshURL += "/return_headers"
-	headers, _ := refresh.refreshRequestObject(c, r, endpoint{
+	headers, _ := refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method:  "POST",
 		Headers: []dataObject{dataObject{Key: "one", Value: "asdf"}, dataObject{Key: "two", Value: "fdsa"}},
 	}, map[string]string{})
@@ -431,7 +433,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing header values are replaced")
 	refresh.refreshURL += "/return_headers"
-	headers, _ = refresh.refreshRequestObject(c, r, endpoint{
+	headers, _ = refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Headers: []dataObject{
 			dataObject{Key: "one", Value: "{asdf}"},
@@ -445,7 +447,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing client.Do error will pass error down")
 	refresh.refreshURL = "error"
-	_, err = refresh.refreshRequestObject(c, r, endpoint{Method: "POST"}, map[string]string{})
+	_, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "POST"}, map[string]string{})
 	if err == nil {
 		t.Errorf("Expected an error to come back from Do")
 	}
@@ -456,7 +458,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing failure identified in response body by status")
 	refresh.refreshURL += "/eof"
-	_, err = refresh.refreshRequestObject(c, r, endpoint{Method: "POST"}, map[string]string{})
+	_, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "POST"}, map[string]string{})
 
 	if !strings.Contains(err.Error(), "EOF") {
 		t.Errorf("Expected EOF on an empty body")
@@ -465,7 +467,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing failure identified in response body by status")
 	refresh.refreshURL += "/failure_status"
-	failed, err := refresh.refreshRequestObject(c, r, endpoint{
+	failed, err := refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Failures: []failure{failure{
 			Validation:   "status",
@@ -485,7 +487,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing failure identified in response body by body key presence")
 	refresh.refreshURL += "/failure_presence"
-	failed, err = refresh.refreshRequestObject(c, r, endpoint{
+	failed, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Failures: []failure{failure{
 			Validation:   "presence",
@@ -505,7 +507,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing presence failure adds response value to error message")
 	refresh.refreshURL += "/failure_presence"
-	failed, err = refresh.refreshRequestObject(c, r, endpoint{
+	failed, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Failures: []failure{failure{
 			Validation:   "presence",
@@ -522,7 +524,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing failure identified in response body by body key value equality")
 	refresh.refreshURL += "/failure_equality"
-	failed, err = refresh.refreshRequestObject(c, r, endpoint{
+	failed, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Failures: []failure{failure{
 			Validation:   "equality",
@@ -542,7 +544,7 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing equality failure adds value to error message")
 	refresh.refreshURL += "/failure_equality"
-	failed, err = refresh.refreshRequestObject(c, r, endpoint{
+	failed, err = refresh.refreshRequestObject(context.Background(), c, r, endpoint{
 		Method: "POST",
 		Failures: []failure{failure{
 			Validation:   "equality",
@@ -559,9 +561,23 @@ func TestRefreshRequestObject(t *testing.T) {
 
 	t.Log("Testing response key found in response body")
 	refresh.refreshURL += "/failure_equality"
-	message, err := refresh.refreshRequestObject(c, r, endpoint{Method: "POST", Responsekey: "message"}, map[string]string{})
+	message, err := refresh.refreshRequestObject(context.Background(), c, r, endpoint{Method: "POST", Responsekey: "message"}, map[string]string{})
 
 	if !strings.Contains(string(message), "something happened") {
 		t.Errorf("Value in response object was not found")
 	}
 }
+
+func TestResultKeyUncacheable(t *testing.T) {
+	defer func(k string) { resultKey = k }(resultKey)
+
+	resultKey = ""
+	if _, err := backend.NewCache(withResult(&Refresh{}), time.Minute, 0, 0); err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	}
+
+	resultKey = "security_context"
+	if _, err := backend.NewCache(withResult(&Refresh{}), time.Minute, 0, 0); err != backend.ErrUncacheable {
+		t.Errorf("Expected `%v` got `%v`", backend.ErrUncacheable, err)
+	}
+}
@@ -25,17 +25,31 @@
 package simple
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/freman/caddy-reauth/backend"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Backend name
 const Backend = "simple"
 
-// Simple is the simplest backend for authentication, a name:password map
+// DefaultCost of generated password hashes
+const DefaultCost = bcrypt.DefaultCost
+
+// Simple is the simplest backend for authentication, a name:password map.
+// Passwords may be given in plain text or as bcrypt hashes, inline or in a
+// file of username:password lines that is reloaded when it changes.
 type Simple struct {
 	credentials map[string]string
+	file        *backend.WatchedFile
 }
 
 func init() {
@@ -51,21 +65,114 @@ func constructor(config string) (backend.Backend, error) {
 		return nil, err
 	}
 
-	return &Simple{
+	h := &Simple{
 		credentials: options,
-	}, nil
+	}
+
+	// file and reload are options rather than users
+	if path, found := options["file"]; found {
+		delete(options, "file")
+
+		interval := backend.DefaultReloadInterval
+		if s, found := options["reload"]; found {
+			delete(options, "reload")
+			if interval, err = time.ParseDuration(s); err != nil {
+				return nil, fmt.Errorf("unable to parse reload %s: %v", s, err)
+			}
+			if interval <= 0 {
+				return nil, errors.New("reload must be positive")
+			}
+		}
+
+		if h.file, err = backend.WatchFile(path, interval, parseFile); err != nil {
+			return nil, err
+		}
+	} else if _, found := options["reload"]; found {
+		return nil, errors.New("reload requires file")
+	}
+
+	return h, nil
+}
+
+// parseFile parses username:password lines, blank lines and lines starting
+// with # are ignored
+func parseFile(data []byte) (interface{}, error) {
+	credentials := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 || pair[0] == "" {
+			return nil, fmt.Errorf("line %d: expected username:password", n)
+		}
+		if _, found := credentials[pair[0]]; found {
+			return nil, fmt.Errorf("line %d: duplicate username %s", n, pair[0])
+		}
+		credentials[pair[0]] = pair[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// An empty file is more likely to be half written than intended
+	if len(credentials) == 0 {
+		return nil, errors.New("no credentials found")
+	}
+
+	return credentials, nil
 }
 
 // Authenticate fulfils the backend interface
 func (h Simple) Authenticate(r *http.Request) (bool, error) {
+	id, err := h.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface
+func (h Simple) AuthenticateIdentity(r *http.Request) (*backend.Identity, error) {
 	un, pw, k := r.BasicAuth()
 	if !k {
-		return false, nil
+		return nil, nil
 	}
 
-	if p, found := h.credentials[un]; !(found && p == pw) {
-		return false, nil
+	p, found := h.credentials[un]
+	if !found && h.file != nil {
+		p, found = h.file.Load().(map[string]string)[un]
+	}
+	if !(found && checkPassword(p, pw)) {
+		return nil, nil
 	}
 
-	return true, nil
+	return &backend.Identity{Username: un}, nil
+}
+
+// AuthenticateContext fulfils the context backend interface
+func (h Simple) AuthenticateContext(ctx context.Context, r *http.Request) (*backend.Identity, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return h.AuthenticateIdentity(r)
+}
+
+// Hash returns a bcrypt hash of the password suitable for use in place of
+// the plain text password
+func Hash(password string, cost int) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(b), err
+}
+
+func checkPassword(expect, password string) bool {
+	if isHash(expect) {
+		return bcrypt.CompareHashAndPassword([]byte(expect), []byte(password)) == nil
+	}
+	return expect == password
+}
+
+func isHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
 }
@@ -2,7 +2,10 @@ package simple
 
 import (
 	"errors"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -39,6 +42,132 @@ func TestAuthenticate(t *testing.T) {
 	if !ok {
 		t.Error("Authenticate should have succeeded")
 	}
+
+	t.Log("Testing identity")
+	id, err := auth.AuthenticateIdentity(r)
+	if err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	}
+	if id == nil || id.Username != "bob-bcrypt" {
+		t.Errorf("Expected identity for bob-bcrypt, got %v", id)
+	}
+}
+
+func TestAuthenticateHash(t *testing.T) {
+	hash, err := Hash("secret", 4)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Simple{credentials: map[string]string{"bob-bcrypt": hash}}
+
+	for password, expect := range map[string]bool{"secret": true, "blogs": false, hash: false} {
+		r, _ := http.NewRequest("GET", "https://test.example.com", nil)
+		r.SetBasicAuth("bob-bcrypt", password)
+		ok, err := auth.Authenticate(r)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if ok != expect {
+			t.Errorf("Expected %v for %q got %v", expect, password, ok)
+		}
+	}
+}
+
+func TestAuthenticateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "simple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err := Hash("secret", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(path, []byte("# users\nbob-bcrypt:"+hash+"\n\nfred:blogs\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	be, err := constructor("file=" + path + ",inline=password")
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+	auth := be.(*Simple)
+
+	check := func(username, password string, expect bool) {
+		t.Helper()
+		r, _ := http.NewRequest("GET", "https://test.example.com", nil)
+		r.SetBasicAuth(username, password)
+		ok, err := auth.Authenticate(r)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if ok != expect {
+			t.Errorf("Expected %v for %s got %v", expect, username, ok)
+		}
+	}
+
+	t.Log("Testing credentials from the file")
+	check("bob-bcrypt", "secret", true)
+	check("fred", "blogs", true)
+	check("fred", "wrong", false)
+	check("inline", "password", true)
+
+	t.Log("Testing changed file")
+	if err := ioutil.WriteFile(path, []byte("fred:changed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.file.Reload(); err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+	check("bob-bcrypt", "secret", false)
+	check("fred", "blogs", false)
+	check("fred", "changed", true)
+
+	t.Log("Testing invalid file")
+	if err := ioutil.WriteFile(path, []byte("fred\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.file.Reload(); err == nil {
+		t.Error("Expected an error, didn't get one")
+	}
+	check("fred", "changed", true)
+}
+
+func TestParseFile(t *testing.T) {
+	tests := []struct {
+		desc   string
+		data   string
+		expect map[string]string
+		err    error
+	}{
+		{`Users`, "# comment\nbob:secret\n\n  fred:pass:word  \n", map[string]string{"bob": "secret", "fred": "pass:word"}, nil},
+		{`Empty file`, "# nobody\n", nil, errors.New(`no credentials found`)},
+		{`Missing password`, "bob:secret\nfred\n", nil, errors.New(`line 2: expected username:password`)},
+		{`Missing username`, ":secret\n", nil, errors.New(`line 1: expected username:password`)},
+		{`Duplicate user`, "bob:secret\nbob:other\n", nil, errors.New(`line 2: duplicate username bob`)},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing file %d (%s)", i+1, tc.desc)
+		v, err := parseFile([]byte(tc.data))
+		if tc.err != nil {
+			if err == nil {
+				t.Error("Expected error, got none")
+			} else if err.Error() != tc.err.Error() {
+				t.Errorf("Expected `%v` got `%v`", tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		} else if !reflect.DeepEqual(tc.expect, v) {
+			t.Errorf("Expected %v got %v", tc.expect, v)
+		}
+	}
 }
 
 func TestAuthenticateConstructor(t *testing.T) {
@@ -63,6 +192,11 @@ func TestAuthenticateConstructor(t *testing.T) {
 			`username=password,bob=bcrypt`,
 			&Simple{credentials: map[string]string{"username": "password", "bob": "bcrypt"}},
 			nil,
+		}, {
+			`Test reload without file`,
+			`reload=30s,bob=secret`,
+			nil,
+			errors.New(`reload requires file`),
 		}, {
 			`Test bad configuration`,
 			`username`,
@@ -25,6 +25,7 @@
 package upstream
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -53,6 +54,7 @@ type Upstream struct {
 	followRedirects    bool
 	passCookies        bool
 	match              *regexp.Regexp
+	trustUsername      bool
 }
 
 func init() {
@@ -119,6 +121,14 @@ func constructor(config string) (backend.Backend, error) {
 		us.passCookies = b
 	}
 
+	if s, found := options["trust_username"]; found {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse trust_username %s: %v", s, err)
+		}
+		us.trustUsername = b
+	}
+
 	if s, found := options["match"]; found {
 		us.match, err = regexp.Compile(s)
 		if err != nil {
@@ -131,9 +141,23 @@ func constructor(config string) (backend.Backend, error) {
 
 // Authenticate fulfils the backend interface
 func (h Upstream) Authenticate(r *http.Request) (bool, error) {
+	id, err := h.AuthenticateIdentity(r)
+	return id != nil, err
+}
+
+// AuthenticateIdentity fulfils the identity backend interface. Upstream
+// servers may not check the username, token based ones often don't, so the
+// identity only carries the http basic username if it is trusted.
+func (h Upstream) AuthenticateIdentity(r *http.Request) (*backend.Identity, error) {
+	return h.AuthenticateContext(r.Context(), r)
+}
+
+// AuthenticateContext fulfils the context backend interface, the request to
+// the upstream server is abandoned once the context is done
+func (h Upstream) AuthenticateContext(ctx context.Context, r *http.Request) (*backend.Identity, error) {
 	un, pw, k := r.BasicAuth()
 	if !(k || h.passCookies) {
-		return false, nil
+		return nil, nil
 	}
 
 	c := &http.Client{
@@ -152,8 +176,9 @@ func (h Upstream) Authenticate(r *http.Request) (bool, error) {
 
 	req, err := http.NewRequest("GET", h.url.String(), nil)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	if k {
 		req.SetBasicAuth(un, pw)
@@ -167,17 +192,24 @@ func (h Upstream) Authenticate(r *http.Request) (bool, error) {
 
 	resp, err := c.Do(req)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	if resp.StatusCode != 200 {
-		return false, nil
+		return nil, nil
 	}
 
 	if h.match != nil && h.match.MatchString(resp.Request.URL.String()) {
-		return false, nil
+		return nil, nil
 	}
 
-	return true, nil
+	if !h.trustUsername {
+		return &backend.Identity{}, nil
+	}
+	return &backend.Identity{Username: un}, nil
+}
 
+// HealthCheck fulfils the health checker interface
+func (h Upstream) HealthCheck(ctx context.Context) error {
+	return backend.CheckURL(ctx, h.url.String(), h.timeout, h.insecureSkipVerify)
 }
@@ -1,6 +1,7 @@
 package upstream
 
 import (
+	"context"
 	"crypto/x509"
 	"errors"
 	"io/ioutil"
@@ -270,6 +271,74 @@ func TestAuthenticateCookieRedirect(t *testing.T) {
 	}
 }
 
+func TestAuthenticateUsername(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A token based upstream that ignores the username
+		if _, p, _ := r.BasicAuth(); p != "token" {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	uri, _ := url.Parse(srv.URL)
+
+	r, _ := http.NewRequest("GET", "https://test.example.com", nil)
+	r.SetBasicAuth("admin", "token")
+
+	for trust, expect := range map[bool]string{false: "", true: "admin"} {
+		us := Upstream{
+			url:           uri,
+			timeout:       DefaultTimeout,
+			trustUsername: trust,
+		}
+
+		id, err := us.AuthenticateIdentity(r)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if id == nil {
+			t.Error("Authenticate should have succeeded")
+		} else if id.Username != expect {
+			t.Errorf("Expected username %q with trust_username=%v got %q", expect, trust, id.Username)
+		}
+	}
+}
+
+func TestAuthenticateContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	uri, _ := url.Parse(srv.URL)
+
+	us := Upstream{
+		url:     uri,
+		timeout: DefaultTimeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	r, _ := http.NewRequest("GET", "https://test.example.com", nil)
+	r.SetBasicAuth("bob-bcrypt", "secret")
+
+	start := time.Now()
+	id, err := us.AuthenticateContext(ctx, r)
+	if err == nil {
+		t.Error("Expected an error, didn't get one")
+	}
+	if id != nil {
+		t.Error("Authenticate should have failed")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the request to be abandoned, took %v", elapsed)
+	}
+}
+
 func TestAuthenticateConstructor(t *testing.T) {
 	tests := []struct {
 		desc   string
@@ -322,6 +391,16 @@ func TestAuthenticateConstructor(t *testing.T) {
 			`url=http://google.com,cookies=true`,
 			&Upstream{url: &url.URL{Scheme: `http`, Host: `google.com`}, timeout: DefaultTimeout, passCookies: true},
 			nil,
+		}, {
+			`With trusted username`,
+			`url=http://google.com,trust_username=true`,
+			&Upstream{url: &url.URL{Scheme: `http`, Host: `google.com`}, timeout: DefaultTimeout, trustUsername: true},
+			nil,
+		}, {
+			`With invalid trusted username`,
+			`url=http://google.com,trust_username=maybe`,
+			nil,
+			errors.New(`unable to parse trust_username maybe: strconv.ParseBool: parsing "maybe": invalid syntax`),
 		}, {
 			`With invalid pass cookies`,
 			`url=http://google.com,cookies=yay`,
@@ -0,0 +1,191 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+	_ "github.com/freman/caddy-reauth/backends"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// construct looks up the named backend and configures it
+func construct(name, config string) (backend.Backend, error) {
+	constructor, err := backend.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("%v %s", err, name)
+	}
+
+	b, err := constructor(config)
+	if err != nil {
+		return nil, fmt.Errorf("%v for %s", err, name)
+	}
+	return b, nil
+}
+
+func validate(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flags("validate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected a backend and its configuration")
+	}
+
+	if _, err := construct(fs.Arg(0), fs.Arg(1)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "%s: configuration is valid\n", fs.Arg(0))
+	return nil
+}
+
+// headers collects repeated header flags
+type headers []string
+
+func (h *headers) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headers) Set(s string) error {
+	if !strings.Contains(s, ":") {
+		return errors.New("expected name: value")
+	}
+	*h = append(*h, s)
+	return nil
+}
+
+func auth(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flags("auth")
+	username := fs.String("user", "", "http basic username")
+	password := fs.String("password", "", "http basic password, prompted for if a user is given without one")
+	target := fs.String("url", "http://localhost/", "url of the request")
+	method := fs.String("method", http.MethodGet, "method of the request")
+	remote := fs.String("remote", "127.0.0.1:0", "address the request comes from")
+	timeout := fs.Duration("timeout", time.Minute, "give up on the backend after this long")
+	var extra headers
+	fs.Var(&extra, "header", "additional request header as `name: value`, may be repeated")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("expected a backend and its configuration")
+	}
+
+	b, err := construct(fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	r, err := http.NewRequest(*method, *target, nil)
+	if err != nil {
+		return err
+	}
+	r.RemoteAddr = *remote
+	for _, h := range extra {
+		kv := strings.SplitN(h, ":", 2)
+		r.Header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	if *username != "" {
+		if *password == "" {
+			if *password, err = readPassword(stdin, stdout, "Password: "); err != nil {
+				return err
+			}
+		}
+		r.SetBasicAuth(*username, *password)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	start := time.Now()
+	id, err := backend.IdentifyContext(ctx, b, r)
+	elapsed := time.Since(start)
+
+	verdict := "denied"
+	switch {
+	case err != nil:
+		verdict = "error"
+	case id != nil:
+		verdict = "allowed"
+	}
+
+	fmt.Fprintf(stdout, "backend:  %s\n", fs.Arg(0))
+	fmt.Fprintf(stdout, "verdict:  %s\n", verdict)
+	fmt.Fprintf(stdout, "time:     %v\n", elapsed)
+	if id != nil {
+		if id.Username != "" {
+			fmt.Fprintf(stdout, "username: %s\n", id.Username)
+		}
+		if len(id.Groups) > 0 {
+			fmt.Fprintf(stdout, "groups:   %s\n", strings.Join(id.Groups, ", "))
+		}
+		keys := make([]string, 0, len(id.Claims))
+		for k := range id.Claims {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(stdout, "claim:    %s=%s\n", k, id.Claims[k])
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	if id == nil {
+		return errDenied
+	}
+	return nil
+}
+
+// readPassword prompts for a password without echoing it if stdin is a
+// terminal, otherwise it reads the first line
+func readPassword(stdin io.Reader, stdout io.Writer, prompt string) (string, error) {
+	if f, ok := stdin.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := terminal.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errors.New("unable to read password")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
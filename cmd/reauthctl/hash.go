@@ -0,0 +1,72 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/freman/caddy-reauth/backends/simple"
+)
+
+func hash(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flags("hash")
+	cost := fs.Int("cost", simple.DefaultCost, "bcrypt cost")
+	password := fs.String("password", "", "password to hash, prompted for if not given")
+	file := fs.Bool("file", false, "print username:hash for a credentials file rather than username=hash")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return errors.New("expected at most one username")
+	}
+
+	if *password == "" {
+		var err error
+		if *password, err = readPassword(stdin, stdout, "Password: "); err != nil {
+			return err
+		}
+		if *password == "" {
+			return errors.New("refusing to hash an empty password")
+		}
+	}
+
+	h, err := simple.Hash(*password, *cost)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fs.NArg() == 1 && *file:
+		fmt.Fprintf(stdout, "%s:%s\n", fs.Arg(0), h)
+	case fs.NArg() == 1:
+		fmt.Fprintf(stdout, "%s=%s\n", fs.Arg(0), h)
+	default:
+		fmt.Fprintln(stdout, h)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+// Command reauthctl tests and operates reauth backends without running caddy.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// errDenied is returned when an authentication attempt is rejected, it is
+// reported through the exit status alone
+var errDenied = errors.New("denied")
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var commands []command
+
+func init() {
+	// Assigned here as the commands look themselves up for their usage
+	commands = []command{
+		{"validate", "<backend> <config>", "check a backend configuration", validate},
+		{"auth", "[options] <backend> <config>", "run a single authentication attempt against a backend", auth},
+		{"rules", "[Caddyfile]", "list the rules of the reauth blocks in a Caddyfile", rules},
+		{"hash", "[options] [username]", "generate a password hash for the simple backend", hash},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: reauthctl <command> [arguments]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun reauthctl <command> -h for the arguments of a command.\n")
+}
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+
+		err := c.run(os.Args[2:], os.Stdin, os.Stdout)
+		switch {
+		case err == errDenied:
+			os.Exit(2)
+		case err == flag.ErrHelp:
+			os.Exit(0)
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "reauthctl %s: %v\n", c.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	usage()
+	os.Exit(2)
+}
+
+// flags returns a flag set for the command that reports usage errors
+// through its return value
+func flags(name string) *flag.FlagSet {
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		fs.Usage = func() {
+			fmt.Fprintf(fs.Output(), "Usage: reauthctl %s %s\n\n%s\n", c.name, c.usage, c.summary)
+			fs.PrintDefaults()
+		}
+		return fs
+	}
+	panic("unknown command " + name)
+}
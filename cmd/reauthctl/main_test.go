@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		desc string
+		args []string
+		err  string
+	}{
+		{`Valid configuration`, []string{"simple", "bob=secret"}, ``},
+		{`Invalid configuration`, []string{"upstream", "timeout=5s"}, `url is a required parameter for upstream`},
+		{`Unknown backend`, []string{"nope", "x=y"}, `unknown backend nope`},
+		{`Missing configuration`, []string{"simple"}, `expected a backend and its configuration`},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing validate %d (%s)", i+1, tc.desc)
+		var out bytes.Buffer
+		err := validate(tc.args, nil, &out)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("Unexpected error `%v`", err)
+			} else if out.String() != tc.args[0]+": configuration is valid\n" {
+				t.Errorf("Unexpected output %q", out.String())
+			}
+		} else if err == nil || err.Error() != tc.err {
+			t.Errorf("Expected `%v` got `%v`", tc.err, err)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		desc   string
+		args   []string
+		stdin  string
+		err    error
+		output []string
+	}{
+		{`Correct password`, []string{"-user", "bob", "-password", "secret", "simple", "bob=secret"}, ``, nil, []string{"verdict:  allowed", "username: bob"}},
+		{`Wrong password`, []string{"-user", "bob", "-password", "wrong", "simple", "bob=secret"}, ``, errDenied, []string{"verdict:  denied"}},
+		{`Password from stdin`, []string{"-user", "bob", "simple", "bob=secret"}, "secret\n", nil, []string{"verdict:  allowed"}},
+		{`Client address`, []string{"-remote", "10.1.1.1:1234", "ip", "allow=10.0.0.0/8"}, ``, nil, []string{"verdict:  allowed", "claim:    client_ip=10.1.1.1"}},
+		{`Forwarded header`, []string{"-remote", "10.1.1.1:1234", "-header", "X-Forwarded-For: 203.0.113.1", "ip", "allow=10.0.0.0/8,trusted_proxies=10.1.1.1"}, ``, errDenied, []string{"verdict:  denied"}},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing auth %d (%s)", i+1, tc.desc)
+		var out bytes.Buffer
+		err := auth(tc.args, strings.NewReader(tc.stdin), &out)
+		if err != tc.err {
+			t.Errorf("Expected `%v` got `%v`", tc.err, err)
+		}
+		for _, line := range tc.output {
+			if !strings.Contains(out.String(), line+"\n") {
+				t.Errorf("Expected %q in %q", line, out.String())
+			}
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	var out bytes.Buffer
+	if err := hash([]string{"-cost", "4", "bob"}, strings.NewReader("secret\n"), &out); err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	config := strings.TrimSpace(out.String())
+	if !strings.HasPrefix(config, "bob=$2a$04$") {
+		t.Fatalf("Unexpected output %q", config)
+	}
+
+	out.Reset()
+	if err := auth([]string{"-user", "bob", "-password", "secret", "simple", config}, nil, &out); err != nil {
+		t.Errorf("Unexpected error `%v` authenticating with %s", err, config)
+	}
+
+	out.Reset()
+	if err := hash([]string{"-cost", "4", "-password", "secret", "-file", "bob"}, nil, &out); err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	} else if !strings.HasPrefix(out.String(), "bob:$2a$04$") {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+
+	if err := hash(nil, strings.NewReader("\n"), &out); err == nil {
+		t.Error("Expected an error hashing an empty password, didn't get one")
+	}
+}
+
+func TestRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reauthctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caddyfile := filepath.Join(dir, "Caddyfile")
+	err = ioutil.WriteFile(caddyfile, []byte(`example.com {
+		reauth {
+			path /admin
+			simple bob=secret
+		}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := rules([]string{caddyfile}, nil, &out); err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	expect := "example.com\n  rule 1: /admin\n    path /admin\n    simple\n    policy any\n    on_error deny\n    failure httpbasic\n"
+	if out.String() != expect {
+		t.Errorf("Expected %q got %q", expect, out.String())
+	}
+
+	if err := rules([]string{"-"}, strings.NewReader("example.com {\n\troot /srv\n}"), &out); err == nil || err.Error() != "no reauth blocks found" {
+		t.Errorf("Expected `no reauth blocks found` got `%v`", err)
+	}
+	out.Reset()
+	if err := rules([]string{"-"}, strings.NewReader("reauth {\n\tpath /\n\tsimple a=b\n}"), &out); err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	} else if !strings.HasPrefix(out.String(), "rule 1: /\n") {
+		t.Errorf("Unexpected output %q", out.String())
+	}
+}
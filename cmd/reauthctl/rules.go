@@ -0,0 +1,89 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/freman/caddy-reauth"
+)
+
+func rules(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flags("rules")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filename := "Caddyfile"
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		filename = fs.Arg(0)
+	default:
+		fs.Usage()
+		return errors.New("expected at most one Caddyfile")
+	}
+
+	input := stdin
+	if filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	sites, err := reauth.ParseRules(filename, input)
+	if err != nil {
+		return err
+	}
+	if len(sites) == 0 {
+		return errors.New("no reauth blocks found")
+	}
+
+	for i, site := range sites {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		indent := ""
+		if len(site.Addresses) > 0 {
+			fmt.Fprintf(stdout, "%s\n", strings.Join(site.Addresses, ", "))
+			indent = "  "
+		}
+		for j, rule := range site.Rules {
+			fmt.Fprintf(stdout, "%srule %d: %s\n", indent, j+1, rule.Label())
+			for _, line := range rule.Describe() {
+				fmt.Fprintf(stdout, "%s  %s\n", indent, line)
+			}
+		}
+	}
+
+	return nil
+}
@@ -25,7 +25,14 @@
 package reauth
 
 import (
+	"errors"
 	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/freman/caddy-reauth/backend"
 	_ "github.com/freman/caddy-reauth/backends"
@@ -34,10 +41,35 @@ import (
 )
 
 type Rule struct {
-	path       []string
-	exceptions []string
-	backends   []backend.Backend
-	onfail     failure
+	name           string
+	path           []string
+	exceptions     []string
+	pathPatterns   []*regexp.Regexp
+	exceptPatterns []*regexp.Regexp
+	methods        []string
+	exceptMethods  []string
+	getMethods     []string
+	hosts          []string
+	exceptHosts    []string
+	backends       []ruleBackend
+	policy         policy
+	onError        errorPolicy
+	require        requirements
+	onfail         failure
+	forbidden      failure
+	headers        identityHeaders
+	lockout        *lockout
+	audit          *auditLog
+	metricsPath    string
+	session        *sessions
+	login          *loginPage
+	logout         *logoutPage
+	authEndpoint   string
+	credentials    credentials
+	headersUp      []headerUp
+	reportOnly     bool
+	authTimeout    time.Duration
+	parallel       bool
 }
 
 func parseConfiguration(c *caddy.Controller) ([]Rule, error) {
@@ -56,11 +88,14 @@ func parseConfiguration(c *caddy.Controller) ([]Rule, error) {
 			return nil, c.ArgErr()
 		}
 	}
+
+	warnUnreachable(rules)
 	return rules, nil
 }
 
 func parseBlock(c *caddy.Controller) (Rule, error) {
-	r := Rule{backends: []backend.Backend{}}
+	r := Rule{backends: []ruleBackend{}}
+	var havePolicy, haveOnError, haveCredentials, haveMode bool
 	for c.NextBlock() {
 		switch c.Val() {
 		case "path":
@@ -82,14 +117,109 @@ func parseBlock(c *caddy.Controller) (Rule, error) {
 			if c.NextArg() {
 				return r, c.ArgErr()
 			}
-		case "failure":
-			if r.onfail != nil {
+		case "name":
+			if r.name != "" || !c.NextArg() {
 				return r, c.ArgErr()
 			}
+			r.name = c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "path_regexp", "except_regexp", "path_glob", "except_glob":
+			// Patterns expect just one string argument and can be repeated
+			directive := c.Val()
 			if !c.NextArg() {
 				return r, c.ArgErr()
 			}
-			name := c.Val()
+			pattern := c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+
+			compile := regexp.Compile
+			if strings.HasSuffix(directive, "_glob") {
+				compile = compileGlob
+			}
+
+			re, err := compile(pattern)
+			if err != nil {
+				return r, c.Errf("%v for %v", err, directive)
+			}
+
+			if strings.HasPrefix(directive, "path") {
+				r.pathPatterns = append(r.pathPatterns, re)
+			} else {
+				r.exceptPatterns = append(r.exceptPatterns, re)
+			}
+		case "methods":
+			// Methods can be specified multiple times with one or more methods
+			// to protect, all methods are protected if none are given
+			args, err := methodArgs(c)
+			if err != nil {
+				return r, err
+			}
+			r.methods = append(r.methods, args...)
+		case "except_methods":
+			args, err := methodArgs(c)
+			if err != nil {
+				return r, err
+			}
+			r.exceptMethods = append(r.exceptMethods, args...)
+		case "host":
+			// Hosts can be specified multiple times, every host is protected
+			// if none are given
+			args, err := hostArgs(c)
+			if err != nil {
+				return r, err
+			}
+			r.hosts = append(r.hosts, args...)
+		case "except_host":
+			args, err := hostArgs(c)
+			if err != nil {
+				return r, err
+			}
+			r.exceptHosts = append(r.exceptHosts, args...)
+		case "treat_as_get":
+			args, err := methodArgs(c)
+			if err != nil {
+				return r, err
+			}
+			r.getMethods = append(r.getMethods, args...)
+		case "policy":
+			if havePolicy {
+				return r, c.ArgErr()
+			}
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return r, c.ArgErr()
+			}
+
+			p, err := parsePolicy(args[0])
+			if err != nil {
+				return r, c.Errf("%v for policy", err)
+			}
+			r.policy = p
+			havePolicy = true
+		case "on_error":
+			if haveOnError {
+				return r, c.ArgErr()
+			}
+			args := c.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return r, c.ArgErr()
+			}
+			args = append(args, "")
+
+			onError, err := parseErrorPolicy(args[0], args[1])
+			if err != nil {
+				return r, c.Errf("%v for on_error", err)
+			}
+			r.onError = onError
+			haveOnError = true
+		case "lockout":
+			if r.lockout != nil {
+				return r, c.ArgErr()
+			}
 
 			args := ""
 			if c.NextArg() {
@@ -100,20 +230,196 @@ func parseBlock(c *caddy.Controller) (Rule, error) {
 				return r, c.ArgErr()
 			}
 
-			constructor, ok := failureHandlers[name]
-			if !ok {
-				return r, c.Errf("unknown failure handler %v: %v", name, args)
+			l, err := parseLockout(args)
+			if err != nil {
+				return r, c.Errf("%v for lockout", err)
+			}
+			r.lockout = l
+		case "audit":
+			if r.audit != nil {
+				return r, c.ArgErr()
+			}
+
+			a, err := parseAuditLog(c.RemainingArgs())
+			if err != nil {
+				return r, c.Errf("%v for audit", err)
+			}
+			r.audit = a
+		case "metrics":
+			if r.metricsPath != "" || !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			r.metricsPath = c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "session":
+			if r.session != nil || !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			config := c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+
+			s, err := parseSessions(config)
+			if err != nil {
+				return r, c.Errf("%v for session", err)
+			}
+			r.session = s
+		case "login":
+			if r.login != nil || !c.NextArg() {
+				return r, c.ArgErr()
 			}
-			onfail, err := constructor(args)
+			config := c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+
+			l, err := parseLoginPage(config)
 			if err != nil {
-				return r, c.Errf("%v for failure %v", err, name)
+				return r, c.Errf("%v for login", err)
+			}
+			r.login = l
+		case "logout":
+			if r.logout != nil || !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			config := c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+
+			l, err := parseLogoutPage(config)
+			if err != nil {
+				return r, c.Errf("%v for logout", err)
+			}
+			r.logout = l
+		case "auth_endpoint":
+			if r.authEndpoint != "" || !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			r.authEndpoint = c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "credentials":
+			if haveCredentials || !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			config := c.Val()
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+
+			cr, err := parseCredentials(config)
+			if err != nil {
+				return r, c.Errf("%v for credentials", err)
+			}
+			r.credentials = cr
+			haveCredentials = true
+		case "parallel":
+			if r.parallel || c.NextArg() {
+				return r, c.ArgErr()
+			}
+			r.parallel = true
+		case "auth_timeout":
+			if r.authTimeout != 0 || !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			d, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return r, c.Errf("unable to parse auth_timeout %s: %v", c.Val(), err)
+			}
+			if d <= 0 {
+				return r, c.Errf("auth_timeout must be positive")
+			}
+			r.authTimeout = d
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+		case "mode":
+			if haveMode || !c.NextArg() {
+				return r, c.ArgErr()
+			}
+			switch c.Val() {
+			case modeEnforce:
+			case modeReportOnly:
+				r.reportOnly = true
+			default:
+				return r, c.Errf("unknown mode %v", c.Val())
+			}
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+			haveMode = true
+		case "header_up":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return r, c.ArgErr()
+			}
+
+			h, err := parseHeaderUp(args[0], strings.Join(args[1:], " "))
+			if err != nil {
+				return r, c.Errf("%v for header_up", err)
+			}
+			r.headersUp = append(r.headersUp, h)
+		case "identity_headers":
+			if r.headers != (identityHeaders{}) {
+				return r, c.ArgErr()
+			}
+
+			args := ""
+			if c.NextArg() {
+				args = c.Val()
+			}
+
+			if c.NextArg() {
+				return r, c.ArgErr()
+			}
+
+			headers, err := parseIdentityHeaders(args)
+			if err != nil {
+				return r, c.Errf("%v for identity_headers", err)
+			}
+			r.headers = headers
+		case "require":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return r, c.ArgErr()
+			}
+			switch args[0] {
+			case "user":
+				r.require.users = append(r.require.users, args[1:]...)
+			case "group":
+				r.require.groups = append(r.require.groups, args[1:]...)
+			default:
+				return r, c.Errf("unknown requirement %v", args[0])
+			}
+		case "failure":
+			if r.onfail != nil {
+				return r, c.ArgErr()
+			}
+			onfail, err := parseFailure(c)
+			if err != nil {
+				return r, err
 			}
 			r.onfail = onfail
+		case "forbidden":
+			if r.forbidden != nil {
+				return r, c.ArgErr()
+			}
+			forbidden, err := parseFailure(c)
+			if err != nil {
+				return r, err
+			}
+			r.forbidden = forbidden
 		default:
-			// Handle backends which should all have just one argument after the plugin name
+			// Handle backends which should all have one argument after the plugin
+			// name and optionally a second argument with reauth's backend options
 			name := c.Val()
 			args := c.RemainingArgs()
-			if len(args) != 1 {
+			if len(args) != 1 && len(args) != 2 {
 				return r, fmt.Errorf("wrong number of arguments for %v: %v (%v:%v)", name, args, c.File(), c.Line())
 			}
 
@@ -129,11 +435,18 @@ func parseBlock(c *caddy.Controller) (Rule, error) {
 				return r, fmt.Errorf("%v for %v (%v:%v)", err, name, c.File(), c.Line())
 			}
 
-			r.backends = append(r.backends, b)
+			rb := ruleBackend{name: name, Backend: b}
+			if len(args) == 2 {
+				if err := rb.configure(args[1]); err != nil {
+					return r, fmt.Errorf("%v for %v (%v:%v)", err, name, c.File(), c.Line())
+				}
+			}
+
+			r.backends = append(r.backends, rb)
 		}
 	}
 
-	if len(r.path) == 0 {
+	if len(r.path) == 0 && len(r.pathPatterns) == 0 {
 		return r, fmt.Errorf("at least one path is required")
 	}
 
@@ -141,8 +454,181 @@ func parseBlock(c *caddy.Controller) (Rule, error) {
 		return r, fmt.Errorf("at least one backend required")
 	}
 
+	if r.login != nil && r.session == nil {
+		return r, fmt.Errorf("login requires session")
+	}
+
+	if r.policy.required(len(r.backends)) > len(r.backends) {
+		return r, fmt.Errorf("policy %v requires more backends than the %d configured", r.policy, len(r.backends))
+	}
+
+	// Breakers are told apart by rule and position, the same backend can
+	// appear in several rules or more than once in one
+	for i, rb := range r.backends {
+		if rb.breaker != nil {
+			rb.breaker.SetName(fmt.Sprintf("%s#%d in %s", rb.name, i+1, r.label()))
+		}
+	}
+
 	if r.onfail == nil {
 		r.onfail = &httpBasicOnFailure{}
 	}
+
+	if r.forbidden == nil && !r.require.empty() {
+		r.forbidden = &httpStatusOnFailure{code: http.StatusForbidden}
+	}
 	return r, nil
 }
+
+// label identifies the rule in logs, its name if it has one otherwise its paths
+func (p Rule) label() string {
+	if p.name != "" {
+		return p.name
+	}
+
+	paths := append([]string{}, p.path...)
+	for _, re := range p.pathPatterns {
+		paths = append(paths, re.String())
+	}
+	return strings.Join(paths, ",")
+}
+
+// configure applies reauth's backend options
+func (rb *ruleBackend) configure(config string) error {
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return err
+	}
+
+	for k := range options {
+		switch k {
+		case "on_error", "retry_after", "cache", "cache_negative", "cache_size", "breaker", "breaker_interval":
+		default:
+			return fmt.Errorf("unknown option %v", k)
+		}
+	}
+
+	if mode, found := options["on_error"]; found {
+		onError, err := parseErrorPolicy(mode, options["retry_after"])
+		if err != nil {
+			return err
+		}
+		rb.onError = &onError
+	} else if _, found := options["retry_after"]; found {
+		return errors.New("retry_after requires on_error=deny")
+	}
+
+	// The breaker sits inside the cache so cached results are still served
+	// while the backend is unavailable
+	if s, found := options["breaker"]; found {
+		threshold, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("unable to parse breaker %s: %v", s, err)
+		}
+		if threshold < 1 {
+			return errors.New("breaker must be at least 1")
+		}
+
+		interval := backend.DefaultBreakerInterval
+		if s, found := options["breaker_interval"]; found {
+			interval, err = time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("unable to parse breaker_interval %s: %v", s, err)
+			}
+		}
+
+		// Named once the rule it belongs to is known
+		rb.breaker = backend.NewBreaker(rb.Backend, "", threshold, interval)
+		rb.Backend = rb.breaker
+	} else if _, found := options["breaker_interval"]; found {
+		return errors.New("breaker_interval requires breaker")
+	}
+
+	if s, found := options["cache"]; found {
+		ttl, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("unable to parse cache %s: %v", s, err)
+		}
+
+		var negativeTTL time.Duration
+		if s, found := options["cache_negative"]; found {
+			negativeTTL, err = time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("unable to parse cache_negative %s: %v", s, err)
+			}
+		}
+
+		size := backend.DefaultCacheSize
+		if s, found := options["cache_size"]; found {
+			size, err = strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("unable to parse cache_size %s: %v", s, err)
+			}
+		}
+
+		rb.Backend, err = backend.NewCache(rb.Backend, ttl, negativeTTL, size)
+		if err != nil {
+			return err
+		}
+	} else if _, found := options["cache_negative"]; found {
+		return errors.New("cache_negative requires cache")
+	} else if _, found := options["cache_size"]; found {
+		return errors.New("cache_size requires cache")
+	}
+
+	return nil
+}
+
+// hostArgs returns the remaining arguments as lower case host patterns
+func hostArgs(c *caddy.Controller) ([]string, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	for i := range args {
+		args[i] = strings.TrimSuffix(strings.ToLower(args[i]), ".")
+		if _, err := path.Match(args[i], ""); err != nil {
+			return nil, c.Errf("invalid host pattern %s", args[i])
+		}
+	}
+	return args, nil
+}
+
+// methodArgs returns the remaining arguments as upper case http methods
+func methodArgs(c *caddy.Controller) ([]string, error) {
+	args := c.RemainingArgs()
+	if len(args) == 0 {
+		return nil, c.ArgErr()
+	}
+	for i := range args {
+		args[i] = strings.ToUpper(args[i])
+	}
+	return args, nil
+}
+
+// parseFailure parses the name and optional configuration of a failure handler
+func parseFailure(c *caddy.Controller) (failure, error) {
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	name := c.Val()
+
+	args := ""
+	if c.NextArg() {
+		args = c.Val()
+	}
+
+	if c.NextArg() {
+		return nil, c.ArgErr()
+	}
+
+	constructor, ok := failureHandlers[name]
+	if !ok {
+		return nil, c.Errf("unknown failure handler %v: %v", name, args)
+	}
+	f, err := constructor(args)
+	if err != nil {
+		return nil, c.Errf("%v for failure %v", err, name)
+	}
+	return f, nil
+}
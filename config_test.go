@@ -3,8 +3,12 @@ package reauth
 import (
 	"errors"
 	"net/http"
+	"net/url"
+	"os"
 	"reflect"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/freman/caddy-reauth/backend"
@@ -19,7 +23,7 @@ func TestCaddyReauthConfigs(t *testing.T) {
 	if err != nil {
 		t.Fatal("Can't use construct backend: ", err)
 	}
-	testBackends := []backend.Backend{simpleBackend}
+	testBackends := []ruleBackend{{name: "simple", Backend: simpleBackend}}
 
 	tests := []struct {
 		desc   string
@@ -226,6 +230,507 @@ func TestCaddyReauthConfigs(t *testing.T) {
 			}`,
 			nil,
 			errors.New(`Testfile:3 - Error during parsing: unknown failure handler foo: `),
+		}, {
+			`Identity headers default to X-Forwarded-User and X-Forwarded-Groups`,
+			`reauth {
+				path /test
+				identity_headers
+				simple username=password
+			}`,
+			[]Rule{{
+				path:     []string{"/test"},
+				backends: testBackends,
+				onfail:   &httpBasicOnFailure{},
+				headers:  identityHeaders{user: "X-Forwarded-User", groups: "X-Forwarded-Groups"},
+			}},
+			nil,
+		}, {
+			`Identity headers can be renamed`,
+			`reauth {
+				path /test
+				identity_headers user=X-Remote-User
+				simple username=password
+			}`,
+			[]Rule{{
+				path:     []string{"/test"},
+				backends: testBackends,
+				onfail:   &httpBasicOnFailure{},
+				headers:  identityHeaders{user: "X-Remote-User"},
+			}},
+			nil,
+		}, {
+			`Only one identity_headers please`,
+			`reauth {
+				path /test
+				identity_headers
+				identity_headers
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:4 - Error during parsing: Wrong argument count or unexpected line ending after 'identity_headers'`),
+		}, {
+			`Policy all`,
+			`reauth {
+				path /test
+				policy all
+				simple username=password
+			}`,
+			[]Rule{{
+				path:     []string{"/test"},
+				backends: testBackends,
+				policy:   policy{kind: policyAll},
+				onfail:   &httpBasicOnFailure{},
+			}},
+			nil,
+		}, {
+			`Policy quorum`,
+			`reauth {
+				path /test
+				policy quorum=1
+				simple username=password
+			}`,
+			[]Rule{{
+				path:     []string{"/test"},
+				backends: testBackends,
+				policy:   policy{kind: policyQuorum, quorum: 1},
+				onfail:   &httpBasicOnFailure{},
+			}},
+			nil,
+		}, {
+			`Policy quorum can't exceed the number of backends`,
+			`reauth {
+				path /test
+				policy quorum=2
+				simple username=password
+			}`,
+			nil,
+			errors.New(`policy quorum=2 requires more backends than the 1 configured`),
+		}, {
+			`Unknown policy`,
+			`reauth {
+				path /test
+				policy most
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: unknown policy most for policy`),
+		}, {
+			`Requirements default to a forbidden status`,
+			`reauth {
+				path /test
+				require user alice bob
+				require group ops
+				simple username=password
+			}`,
+			[]Rule{{
+				path:      []string{"/test"},
+				backends:  testBackends,
+				require:   requirements{users: []string{"alice", "bob"}, groups: []string{"ops"}},
+				onfail:    &httpBasicOnFailure{},
+				forbidden: &httpStatusOnFailure{code: http.StatusForbidden},
+			}},
+			nil,
+		}, {
+			`Forbidden handler can be configured`,
+			`reauth {
+				path /test
+				require user alice
+				forbidden redirect target=/denied
+				simple username=password
+			}`,
+			[]Rule{{
+				path:      []string{"/test"},
+				backends:  testBackends,
+				require:   requirements{users: []string{"alice"}},
+				onfail:    &httpBasicOnFailure{},
+				forbidden: &httpRedirectOnFailure{target: &url.URL{Path: "/denied"}, code: http.StatusFound},
+			}},
+			nil,
+		}, {
+			`Requirements need a name`,
+			`reauth {
+				path /test
+				require group
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'group'`),
+		}, {
+			`Unknown requirement`,
+			`reauth {
+				path /test
+				require role admin
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: unknown requirement role`),
+		}, {
+			`Methods are normalised`,
+			`reauth {
+				path /test
+				methods put post
+				methods DELETE
+				except_methods get
+				treat_as_get HEAD OPTIONS
+				simple username=password
+			}`,
+			[]Rule{{
+				path:          []string{"/test"},
+				methods:       []string{"PUT", "POST", "DELETE"},
+				exceptMethods: []string{"GET"},
+				getMethods:    []string{"HEAD", "OPTIONS"},
+				backends:      testBackends,
+				onfail:        &httpBasicOnFailure{},
+			}},
+			nil,
+		}, {
+			`Methods require arguments`,
+			`reauth {
+				path /test
+				methods
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'methods'`),
+		}, {
+			`Patterns are compiled`,
+			`reauth {
+				path_regexp ^/v[0-9]+/
+				path_glob /api/**
+				except_regexp \.css$
+				except_glob /api/*/health
+				simple username=password
+			}`,
+			[]Rule{{
+				pathPatterns:   []*regexp.Regexp{regexp.MustCompile(`^/v[0-9]+/`), regexp.MustCompile(`^/api/.*$`)},
+				exceptPatterns: []*regexp.Regexp{regexp.MustCompile(`\.css$`), regexp.MustCompile(`^/api/[^/]*/health$`)},
+				backends:       testBackends,
+				onfail:         &httpBasicOnFailure{},
+			}},
+			nil,
+		}, {
+			`Invalid patterns are caught`,
+			`reauth {
+				path_regexp /(
+				simple username=password
+			}`,
+			nil,
+			errors.New("Testfile:2 - Error during parsing: error parsing regexp: missing closing ): `/(` for path_regexp"),
+		}, {
+			`Rule and backend error policies`,
+			`reauth {
+				path /test
+				on_error deny 1m
+				simple username=password on_error=continue
+			}`,
+			[]Rule{{
+				path:     []string{"/test"},
+				backends: []ruleBackend{{name: "simple", onError: &errorPolicy{mode: errorContinue}, Backend: simpleBackend}},
+				onError:  errorPolicy{mode: errorDeny, retryAfter: time.Minute},
+				onfail:   &httpBasicOnFailure{},
+			}},
+			nil,
+		}, {
+			`Retry after is only for deny`,
+			`reauth {
+				path /test
+				on_error open 1m
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: retry after is only supported by deny for on_error`),
+		}, {
+			`Unknown backend options`,
+			`reauth {
+				path /test
+				simple username=password bogus=true
+			}`,
+			nil,
+			errors.New(`unknown option bogus for simple (Testfile:3)`),
+		}, {
+			`Cache options require cache`,
+			`reauth {
+				path /test
+				simple username=password cache_size=10
+			}`,
+			nil,
+			errors.New(`cache_size requires cache for simple (Testfile:3)`),
+		}, {
+			`Client dependent backends can't be cached`,
+			`reauth {
+				path /test
+				ip allow=10.0.0.0/8 cache=5m,breaker=3
+			}`,
+			nil,
+			errors.New(`results of this backend can't be cached for ip (Testfile:3)`),
+		}, {
+			`Breaker options require breaker`,
+			`reauth {
+				path /test
+				simple username=password breaker_interval=10s
+			}`,
+			nil,
+			errors.New(`breaker_interval requires breaker for simple (Testfile:3)`),
+		}, {
+			`Breaker threshold must be positive`,
+			`reauth {
+				path /test
+				simple username=password breaker=0
+			}`,
+			nil,
+			errors.New(`breaker must be at least 1 for simple (Testfile:3)`),
+		}, {
+			`Lockout rejects unknown options`,
+			`reauth {
+				path /test
+				lockout users=5
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: unknown option users for lockout`),
+		}, {
+			`Lockout rejects invalid networks`,
+			`reauth {
+				path /test
+				lockout trusted=10.0.0.0/33
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: invalid CIDR address: 10.0.0.0/33 for lockout`),
+		}, {
+			`Lockout rejects unknown forwarded headers`,
+			`reauth {
+				path /test
+				lockout forwarded_header=x-real-ip
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: unknown forwarded header x-real-ip for lockout`),
+		}, {
+			`Named rule with an audit log`,
+			`reauth {
+				name private
+				path /test
+				audit stderr
+				simple username=password
+			}`,
+			[]Rule{{
+				name:     "private",
+				path:     []string{"/test"},
+				backends: testBackends,
+				onfail:   &httpBasicOnFailure{},
+				audit:    &auditLog{output: "stderr", w: os.Stderr, header: backend.DefaultForwardedHeader},
+			}},
+			nil,
+		}, {
+			`Rotation is only for files`,
+			`reauth {
+				path /test
+				audit stderr rotate_size=10
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: rotation is only supported for files for audit`),
+		}, {
+			`Audit log forwarded header must be known`,
+			`reauth {
+				path /test
+				audit stderr trusted_proxies=192.168.0.1,forwarded_header=x-real-ip
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: unknown forwarded header x-real-ip for audit`),
+		}, {
+			`Sessions require keys`,
+			`reauth {
+				path /test
+				session lifetime=1h
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: keys is a required parameter for session`),
+		}, {
+			`Session keys must be long enough`,
+			`reauth {
+				path /test
+				session keys=short
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: keys must be at least 16 characters for session`),
+		}, {
+			`Login requires sessions`,
+			`reauth {
+				path /test
+				login path=/login
+				simple username=password
+			}`,
+			nil,
+			errors.New(`login requires session`),
+		}, {
+			`Login requires a path`,
+			`reauth {
+				path /test
+				session keys=0123456789abcdef
+				login error=nope
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:4 - Error during parsing: path is a required parameter for login`),
+		}, {
+			`Logout requires a path`,
+			`reauth {
+				path /test
+				logout target=/
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: path is a required parameter for logout`),
+		}, {
+			`Auth endpoint`,
+			`reauth {
+				path /
+				auth_endpoint /auth
+				simple username=password
+			}`,
+			[]Rule{{
+				path:         []string{"/"},
+				backends:     testBackends,
+				onfail:       &httpBasicOnFailure{},
+				authEndpoint: "/auth",
+			}},
+			nil,
+		}, {
+			`Only one auth endpoint please`,
+			`reauth {
+				path /
+				auth_endpoint /auth /other
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after '/other'`),
+		}, {
+			`Hosts`,
+			`reauth {
+				path /
+				host *.Example.com admin.example.org.
+				except_host www.example.com
+				simple username=password
+			}`,
+			[]Rule{{
+				path:        []string{"/"},
+				hosts:       []string{"*.example.com", "admin.example.org"},
+				exceptHosts: []string{"www.example.com"},
+				backends:    testBackends,
+				onfail:      &httpBasicOnFailure{},
+			}},
+			nil,
+		}, {
+			`Invalid host pattern`,
+			`reauth {
+				path /
+				host [example.com
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: invalid host pattern [example.com`),
+		}, {
+			`Only one credentials please`,
+			`reauth {
+				path /
+				credentials strip_authorization=true
+				credentials strip_cookies=session
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:4 - Error during parsing: Wrong argument count or unexpected line ending after 'credentials'`),
+		}, {
+			`Header up needs a template`,
+			`reauth {
+				path /
+				header_up X-User
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'X-User'`),
+		}, {
+			`Header up with an invalid template`,
+			`reauth {
+				path /
+				header_up X-User {{.Username
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: template: X-User:1: unclosed action for header_up`),
+		}, {
+			`Report only mode`,
+			`reauth {
+				path /
+				mode report_only
+				simple username=password
+			}`,
+			[]Rule{{
+				path:       []string{"/"},
+				backends:   testBackends,
+				onfail:     &httpBasicOnFailure{},
+				reportOnly: true,
+			}},
+			nil,
+		}, {
+			`Unknown mode`,
+			`reauth {
+				path /
+				mode relaxed
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: unknown mode relaxed`),
+		}, {
+			`Auth timeout`,
+			`reauth {
+				path /
+				auth_timeout 2s
+				simple username=password
+			}`,
+			[]Rule{{
+				path:        []string{"/"},
+				backends:    testBackends,
+				onfail:      &httpBasicOnFailure{},
+				authTimeout: 2 * time.Second,
+			}},
+			nil,
+		}, {
+			`Negative auth timeout`,
+			`reauth {
+				path /
+				auth_timeout -2s
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: auth_timeout must be positive`),
+		}, {
+			`Parallel`,
+			`reauth {
+				path /
+				parallel
+				simple username=password
+			}`,
+			[]Rule{{
+				path:     []string{"/"},
+				backends: testBackends,
+				onfail:   &httpBasicOnFailure{},
+				parallel: true,
+			}},
+			nil,
+		}, {
+			`Parallel takes no arguments`,
+			`reauth {
+				path /
+				parallel yes
+				simple username=password
+			}`,
+			nil,
+			errors.New(`Testfile:3 - Error during parsing: Wrong argument count or unexpected line ending after 'yes'`),
 		}, {
 			`Only one failure please`,
 			`reauth {
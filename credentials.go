@@ -0,0 +1,109 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// credentials controls what the client's credentials look like once the
+// request is passed downstream
+type credentials struct {
+	stripAuthorization bool
+	stripCookies       []string
+	authorization      string
+}
+
+func parseCredentials(config string) (credentials, error) {
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return credentials{}, err
+	}
+
+	var cr credentials
+	for k, v := range options {
+		switch k {
+		case "strip_authorization":
+			if cr.stripAuthorization, err = strconv.ParseBool(v); err != nil {
+				return cr, fmt.Errorf("unable to parse strip_authorization %s: %v", v, err)
+			}
+		case "strip_cookies":
+			for _, name := range strings.Split(v, ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					cr.stripCookies = append(cr.stripCookies, name)
+				}
+			}
+		case "basic":
+			if !strings.Contains(v, ":") {
+				return cr, errors.New("basic must be in the form username:password")
+			}
+			if cr.authorization != "" {
+				return cr, errors.New("only one of basic or bearer may be given")
+			}
+			cr.authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(v))
+		case "bearer":
+			if cr.authorization != "" {
+				return cr, errors.New("only one of basic or bearer may be given")
+			}
+			cr.authorization = "Bearer " + v
+		default:
+			return cr, fmt.Errorf("unknown option %v", k)
+		}
+	}
+
+	return cr, nil
+}
+
+// apply removes or replaces the credentials in the request
+func (cr credentials) apply(r *http.Request) {
+	if cr.authorization != "" {
+		r.Header.Set("Authorization", cr.authorization)
+	} else if cr.stripAuthorization {
+		r.Header.Del("Authorization")
+	}
+
+	if len(cr.stripCookies) == 0 || r.Header.Get("Cookie") == "" {
+		return
+	}
+
+	var kept []string
+	for _, c := range r.Cookies() {
+		if !containsString(cr.stripCookies, c.Name) {
+			kept = append(kept, c.String())
+		}
+	}
+
+	r.Header.Del("Cookie")
+	if len(kept) > 0 {
+		r.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+}
@@ -0,0 +1,85 @@
+package reauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestCredentials(t *testing.T) {
+	tests := []struct {
+		desc          string
+		config        string
+		authorization string
+		cookie        string
+		err           string
+	}{
+		{`Untouched`, `strip_authorization=false`, "Basic Ym9iOnNlY3JldA==", "session=abc; theme=dark", ``},
+		{`Strip authorization`, `strip_authorization=true`, "", "session=abc; theme=dark", ``},
+		{`Strip cookies`, `strip_cookies="session,other"`, "Basic Ym9iOnNlY3JldA==", "theme=dark", ``},
+		{`Replace with basic`, `basic=service:password,strip_cookies=session`, "Basic c2VydmljZTpwYXNzd29yZA==", "theme=dark", ``},
+		{`Replace with bearer`, `bearer=token,strip_authorization=true`, "Bearer token", "session=abc; theme=dark", ``},
+		{`Invalid basic`, `basic=service`, "", "", `basic must be in the form username:password`},
+		{`Both`, `basic=service:password,bearer=token`, "", "", `only one of basic or bearer may be given`},
+		{`Unknown`, `strip=true`, "", "", `unknown option strip`},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing credentials %d (%s)", i+1, tc.desc)
+		cr, err := parseCredentials(tc.config)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("Expected `%v` got `%v`", tc.err, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+			continue
+		}
+
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.SetBasicAuth("bob", "secret")
+		r.Header.Set("Cookie", "session=abc; theme=dark")
+		cr.apply(r)
+
+		if got := r.Header.Get("Authorization"); got != tc.authorization {
+			t.Errorf("Expected authorization `%v` got `%v`", tc.authorization, got)
+		}
+		if got := r.Header.Get("Cookie"); got != tc.cookie {
+			t.Errorf("Expected cookie `%v` got `%v`", tc.cookie, got)
+		}
+	}
+}
+
+func TestMiddlewareCredentials(t *testing.T) {
+	test := `reauth {
+				path /test
+				credentials strip_authorization=true
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			if r.Header.Get("Authorization") != "" {
+				t.Error("Expected the authorization header to be removed")
+			}
+			return http.StatusOK, nil
+		}),
+	}
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.SetBasicAuth("username", "password")
+	if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusOK {
+		t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// originalRequest rebuilds the request a proxy is asking about from the
+// headers set by nginx's auth_request or traefik's forwardAuth
+func originalRequest(r *http.Request) (*http.Request, bool) {
+	uri := r.Header.Get("X-Original-URI")
+	if uri == "" {
+		uri = r.Header.Get("X-Forwarded-Uri")
+	}
+	if uri == "" {
+		return nil, false
+	}
+
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, false
+	}
+
+	or := r.WithContext(r.Context())
+	or.URL = u
+	or.RequestURI = uri
+
+	if method := r.Header.Get("X-Original-Method"); method != "" {
+		or.Method = method
+	} else if method := r.Header.Get("X-Forwarded-Method"); method != "" {
+		or.Method = method
+	}
+
+	if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+		or.Host = host
+	}
+
+	return or, true
+}
+
+// verify answers forward authentication requests from other proxies, letting
+// the rule decide on the original request and responding with 200 and the
+// identity headers, 401 or 403 instead of proxying anything
+func (h Reauth) verify(w http.ResponseWriter, r *http.Request, p Rule) (int, error) {
+	or, ok := originalRequest(r)
+	if !ok {
+		return http.StatusBadRequest, nil
+	}
+
+	if !p.matches(or) {
+		return http.StatusOK, nil
+	}
+
+	headers := p.headers
+	if headers == (identityHeaders{}) {
+		headers, _ = parseIdentityHeaders("")
+	}
+
+	// Proxies only understand a handful of responses so anything but a basic
+	// auth challenge becomes a plain 401
+	if _, basic := p.onfail.(*httpBasicOnFailure); !basic {
+		p.onfail = &httpStatusOnFailure{code: http.StatusUnauthorized}
+	}
+	p.forbidden = &httpStatusOnFailure{code: http.StatusForbidden}
+
+	v := Reauth{next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		if id, ok := r.Context().Value(IdentityCtxKey).(*backend.Identity); ok {
+			headers.set(w.Header(), id)
+		}
+		for _, hu := range p.headersUp {
+			if v := r.Header.Get(hu.name); v != "" {
+				w.Header().Set(hu.name, v)
+			}
+		}
+		return http.StatusOK, nil
+	})}
+
+	if p.reportOnly {
+		v.evaluate(or, p)
+		return http.StatusOK, nil
+	}
+
+	return v.protect(w, or, p)
+}
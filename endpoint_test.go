@@ -0,0 +1,70 @@
+package reauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestMiddlewareAuthEndpoint(t *testing.T) {
+	test := `reauth {
+				path /
+				except /public
+				auth_endpoint /auth
+				require user admin
+				simple username=password,admin=secret
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	tests := []struct {
+		desc     string
+		headers  map[string]string
+		username string
+		password string
+		expect   int
+		user     string
+	}{
+		{`No original uri`, nil, "", "", http.StatusBadRequest, ""},
+		{`Unprotected uri`, map[string]string{"X-Original-URI": "/public/index.html"}, "", "", http.StatusOK, ""},
+		{`No credentials`, map[string]string{"X-Original-URI": "/private"}, "", "", http.StatusUnauthorized, ""},
+		{`Wrong credentials`, map[string]string{"X-Forwarded-Uri": "/private"}, "admin", "wrong", http.StatusUnauthorized, ""},
+		{`Not permitted`, map[string]string{"X-Original-URI": "/private"}, "username", "password", http.StatusForbidden, ""},
+		{`Permitted`, map[string]string{"X-Forwarded-Uri": "/private", "X-Forwarded-Method": "POST"}, "admin", "secret", http.StatusOK, "admin"},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing auth endpoint %d (%s)", i+1, tc.desc)
+		req, _ := http.NewRequest("GET", "/auth", nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		if tc.username != "" {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+
+		rec := httptest.NewRecorder()
+		result, err := auth.ServeHTTP(rec, req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != tc.expect {
+			t.Errorf("Expected `%v` got `%v`", tc.expect, result)
+		}
+		if user := rec.Header().Get(DefaultUserHeader); user != tc.user {
+			t.Errorf("Expected user `%v` got `%v`", tc.user, user)
+		}
+	}
+}
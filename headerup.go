@@ -0,0 +1,98 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// headerUp is a request header set from a template once a request has been
+// authenticated
+type headerUp struct {
+	name     string
+	template *template.Template
+}
+
+// headerUpData is passed to header_up templates
+type headerUpData struct {
+	Username string
+	Groups   []string
+	Claims   map[string]string
+	Backend  string
+	Backends []string
+	Request  *http.Request
+}
+
+var headerUpFuncs = template.FuncMap{
+	"join":  func(sep string, s []string) string { return strings.Join(s, sep) },
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+func parseHeaderUp(name, text string) (headerUp, error) {
+	name = http.CanonicalHeaderKey(name)
+	t, err := template.New(name).Funcs(headerUpFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return headerUp{}, err
+	}
+	return headerUp{name: name, template: t}, nil
+}
+
+// setHeadersUp replaces the configured headers in the request with their
+// templates evaluated against the identity
+func setHeadersUp(headers []headerUp, r *http.Request, id *backend.Identity, backends []string) {
+	data := headerUpData{
+		Username: id.Username,
+		Groups:   id.Groups,
+		Claims:   id.Claims,
+		Backends: backends,
+		Request:  r,
+	}
+	if len(backends) > 0 {
+		data.Backend = backends[0]
+	}
+
+	for _, h := range headers {
+		var buf bytes.Buffer
+		if err := h.template.Execute(&buf, data); err != nil {
+			log.Printf("[ERROR] reauth: unable to evaluate header_up %s: %v", h.name, err)
+			r.Header.Del(h.name)
+			continue
+		}
+
+		value := strings.NewReplacer("\r", " ", "\n", " ").Replace(buf.String())
+		if value == "" {
+			r.Header.Del(h.name)
+			continue
+		}
+		r.Header.Set(h.name, value)
+	}
+}
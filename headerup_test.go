@@ -0,0 +1,95 @@
+package reauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+func TestSetHeadersUp(t *testing.T) {
+	var headers []headerUp
+	for name, text := range map[string]string{
+		"x-user":    `{{.Username}}`,
+		"X-Groups":  `{{join "," .Groups}}`,
+		"X-Mail":    `{{.Claims.mail}}`,
+		"X-Phone":   `{{.Claims.phone}}`,
+		"X-Backend": `{{.Backend}} of {{len .Backends}}`,
+		"X-Host":    `{{lower .Request.Host}}`,
+	} {
+		h, err := parseHeaderUp(name, text)
+		if err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+		headers = append(headers, h)
+	}
+
+	r, _ := http.NewRequest("GET", "http://Example.com/", nil)
+	r.Header.Set("X-Phone", "spoofed")
+	id := &backend.Identity{Username: "bob", Groups: []string{"ops", "dev"}, Claims: map[string]string{"mail": "bob@example.com"}}
+	setHeadersUp(headers, r, id, []string{"ldap", "upstream"})
+
+	for name, expect := range map[string]string{
+		"X-User":    "bob",
+		"X-Groups":  "ops,dev",
+		"X-Mail":    "bob@example.com",
+		"X-Phone":   "",
+		"X-Backend": "ldap of 2",
+		"X-Host":    "example.com",
+	} {
+		if got := r.Header.Get(name); got != expect {
+			t.Errorf("Expected %s `%v` got `%v`", name, expect, got)
+		}
+	}
+
+	if _, err := parseHeaderUp("X-Broken", `{{.Username`); err == nil {
+		t.Error("Expected an error for an invalid template")
+	}
+}
+
+func TestMiddlewareHeaderUp(t *testing.T) {
+	test := `reauth {
+				path /test
+				header_up X-Remote-User {{.Username}}
+				header_up X-Auth-Backend "via {{.Backend}}"
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	var seen http.Header
+	auth := &Reauth{
+		rules: rules,
+		next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			seen = r.Header
+			return http.StatusOK, nil
+		}),
+	}
+
+	t.Log("Testing client supplied headers are removed")
+	req, _ := http.NewRequest("GET", "/public", nil)
+	req.Header.Set("X-Remote-User", "admin")
+	auth.ServeHTTP(httptest.NewRecorder(), req)
+	if v := seen.Get("X-Remote-User"); v != "" {
+		t.Errorf("Expected no X-Remote-User got `%v`", v)
+	}
+
+	t.Log("Testing headers are set once authenticated")
+	req, _ = http.NewRequest("GET", "/test", nil)
+	req.Header.Set("X-Remote-User", "admin")
+	req.SetBasicAuth("username", "password")
+	auth.ServeHTTP(httptest.NewRecorder(), req)
+	if v := seen.Get("X-Remote-User"); v != "username" {
+		t.Errorf("Expected X-Remote-User `username` got `%v`", v)
+	}
+	if v := seen.Get("X-Auth-Backend"); v != "via simple" {
+		t.Errorf("Expected X-Auth-Backend `via simple` got `%v`", v)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// IdentityCtxKey is the context key for the *backend.Identity of an authenticated request
+const IdentityCtxKey caddy.CtxKey = "reauth_identity"
+
+// Default header names used when identity_headers is given without configuration
+const (
+	DefaultUserHeader   = "X-Forwarded-User"
+	DefaultGroupsHeader = "X-Forwarded-Groups"
+)
+
+type identityHeaders struct {
+	user   string
+	groups string
+}
+
+func parseIdentityHeaders(config string) (identityHeaders, error) {
+	if config == "" {
+		return identityHeaders{user: DefaultUserHeader, groups: DefaultGroupsHeader}, nil
+	}
+
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return identityHeaders{}, err
+	}
+
+	return identityHeaders{user: options["user"], groups: options["groups"]}, nil
+}
+
+// strip removes any client supplied identity headers so they can't be spoofed
+func (h identityHeaders) strip(r *http.Request) {
+	if h.user != "" {
+		r.Header.Del(h.user)
+	}
+	if h.groups != "" {
+		r.Header.Del(h.groups)
+	}
+}
+
+func (h identityHeaders) set(header http.Header, id *backend.Identity) {
+	if h.user != "" && id.Username != "" {
+		header.Set(h.user, id.Username)
+	}
+	if h.groups != "" && len(id.Groups) > 0 {
+		header.Set(h.groups, strings.Join(id.Groups, ","))
+	}
+}
+
+// identify attaches the identity to the request context and headers
+func (h identityHeaders) identify(r *http.Request, id *backend.Identity) *http.Request {
+	h.set(r.Header, id)
+
+	ctx := context.WithValue(r.Context(), IdentityCtxKey, id)
+	if id.Username != "" {
+		ctx = context.WithValue(ctx, httpserver.RemoteUserCtxKey, id.Username)
+	}
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,208 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// Site holds the reauth rules configured for the addresses of a server block
+type Site struct {
+	Addresses []string
+	Rules     []Rule
+}
+
+// ParseRules parses the reauth directives of a Caddyfile for tools that want
+// to inspect the configuration without running caddy. The input may also be
+// just reauth blocks, which are returned as a single site without addresses.
+func ParseRules(filename string, input io.Reader) ([]Site, error) {
+	body, err := ioutil.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	d := caddyfile.NewDispenser(filename, bytes.NewReader(body))
+	if d.Next() && d.Val() == "reauth" {
+		rules, err := parseConfiguration(&caddy.Controller{Dispenser: caddyfile.NewDispenser(filename, bytes.NewReader(body))})
+		if err != nil {
+			return nil, err
+		}
+		return []Site{{Rules: rules}}, nil
+	}
+
+	blocks, err := caddyfile.Parse(filename, bytes.NewReader(body), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var sites []Site
+	for _, sb := range blocks {
+		tokens, found := sb.Tokens["reauth"]
+		if !found {
+			continue
+		}
+		rules, err := parseConfiguration(&caddy.Controller{Dispenser: caddyfile.NewDispenserTokens(filename, tokens)})
+		if err != nil {
+			return nil, err
+		}
+		sites = append(sites, Site{Addresses: sb.Keys, Rules: rules})
+	}
+
+	return sites, nil
+}
+
+// Label identifies the rule, its name if it has one otherwise its paths
+func (p Rule) Label() string {
+	return p.label()
+}
+
+// Describe summarises the rule one directive per line, backend configuration
+// is left out as it often holds secrets
+func (p Rule) Describe() []string {
+	var lines []string
+	add := func(directive string, args ...string) {
+		lines = append(lines, strings.TrimSpace(directive+" "+strings.Join(args, " ")))
+	}
+	each := func(directive string, args []string) {
+		for _, arg := range args {
+			add(directive, arg)
+		}
+	}
+
+	if p.name != "" {
+		add("name", p.name)
+	}
+	each("path", p.path)
+	each("except", p.exceptions)
+	for _, re := range p.pathPatterns {
+		add("path_regexp", re.String())
+	}
+	for _, re := range p.exceptPatterns {
+		add("except_regexp", re.String())
+	}
+	if len(p.methods) > 0 {
+		add("methods", p.methods...)
+	}
+	if len(p.exceptMethods) > 0 {
+		add("except_methods", p.exceptMethods...)
+	}
+	if len(p.getMethods) > 0 {
+		add("treat_as_get", p.getMethods...)
+	}
+	if len(p.hosts) > 0 {
+		add("host", p.hosts...)
+	}
+	if len(p.exceptHosts) > 0 {
+		add("except_host", p.exceptHosts...)
+	}
+
+	for _, rb := range p.backends {
+		var options []string
+		if rb.onError != nil {
+			options = append(options, "on_error="+rb.onError.String())
+		}
+		if _, ok := rb.Backend.(*backend.Cache); ok {
+			options = append(options, "cache")
+		}
+		if len(options) > 0 {
+			add(rb.name, strings.Join(options, ","))
+		} else {
+			add(rb.name)
+		}
+	}
+
+	add("policy", p.policy.String())
+	add("on_error", p.onError.String())
+	if p.parallel {
+		add("parallel")
+	}
+	if p.authTimeout > 0 {
+		add("auth_timeout", p.authTimeout.String())
+	}
+	if p.reportOnly {
+		add("mode", "report_only")
+	}
+
+	each("require user", p.require.users)
+	each("require group", p.require.groups)
+	add("failure", describeFailure(p.onfail))
+	if p.forbidden != nil {
+		add("forbidden", describeFailure(p.forbidden))
+	}
+
+	if p.session != nil {
+		add("session", "name="+p.session.name+",lifetime="+p.session.lifetime.String())
+	}
+	if p.login != nil {
+		add("login", p.login.path)
+	}
+	if p.logout != nil {
+		add("logout", p.logout.path)
+	}
+	if p.authEndpoint != "" {
+		add("auth_endpoint", p.authEndpoint)
+	}
+	if p.lockout != nil {
+		add("lockout", fmt.Sprintf("user=%d,ip=%d,window=%v", p.lockout.userLimit, p.lockout.ipLimit, p.lockout.window))
+	}
+	if p.audit != nil {
+		add("audit", p.audit.output)
+	}
+	if p.metricsPath != "" {
+		add("metrics", p.metricsPath)
+	}
+	if p.headers.user != "" || p.headers.groups != "" {
+		add("identity_headers", "user="+p.headers.user+",groups="+p.headers.groups)
+	}
+	for _, h := range p.headersUp {
+		add("header_up", h.name)
+	}
+
+	return lines
+}
+
+func describeFailure(f failure) string {
+	switch h := f.(type) {
+	case *httpBasicOnFailure:
+		if h.realm != "" {
+			return "httpbasic realm=" + h.realm
+		}
+		return "httpbasic"
+	case *httpRedirectOnFailure:
+		return fmt.Sprintf("redirect target=%v,code=%d", h.target, h.code)
+	case *httpStatusOnFailure:
+		return "status code=" + strconv.Itoa(h.code)
+	}
+	return fmt.Sprintf("%T", f)
+}
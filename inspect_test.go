@@ -0,0 +1,118 @@
+package reauth
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	tests := []struct {
+		desc   string
+		input  string
+		expect []Site
+	}{{
+		desc: "lone reauth blocks",
+		input: `reauth {
+				path /a
+				simple user=pass
+			}
+			reauth {
+				path /b
+				simple user=pass
+			}`,
+		expect: []Site{{Rules: []Rule{{path: []string{"/a"}}, {path: []string{"/b"}}}}},
+	}, {
+		desc: "caddyfile",
+		input: `example.com, www.example.com {
+				root /srv
+				reauth {
+					path /a
+					simple user=pass
+				}
+			}
+			other.example.com {
+				root /srv
+			}
+			api.example.com {
+				reauth {
+					path /b
+					simple user=pass
+				}
+			}`,
+		expect: []Site{
+			{Addresses: []string{"example.com", "www.example.com"}, Rules: []Rule{{path: []string{"/a"}}}},
+			{Addresses: []string{"api.example.com"}, Rules: []Rule{{path: []string{"/b"}}}},
+		},
+	}}
+
+	for i, tc := range tests {
+		t.Logf("Testing caddyfile %d (%s)", i+1, tc.desc)
+		sites, err := ParseRules("Caddyfile", strings.NewReader(tc.input))
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+			continue
+		}
+		if len(sites) != len(tc.expect) {
+			t.Errorf("Expected %d sites got %d", len(tc.expect), len(sites))
+			continue
+		}
+		for j, site := range sites {
+			if !reflect.DeepEqual(site.Addresses, tc.expect[j].Addresses) {
+				t.Errorf("Expected addresses %v got %v", tc.expect[j].Addresses, site.Addresses)
+			}
+			if len(site.Rules) != len(tc.expect[j].Rules) {
+				t.Errorf("Expected %d rules got %d", len(tc.expect[j].Rules), len(site.Rules))
+				continue
+			}
+			for k, rule := range site.Rules {
+				if !reflect.DeepEqual(rule.path, tc.expect[j].Rules[k].path) {
+					t.Errorf("Expected path %v got %v", tc.expect[j].Rules[k].path, rule.path)
+				}
+			}
+		}
+	}
+
+	if _, err := ParseRules("Caddyfile", strings.NewReader("reauth {\n\tpath /\n\tnope\n}")); err == nil {
+		t.Error("Expected an error, didn't get one")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	sites, err := ParseRules("Caddyfile", strings.NewReader(`reauth {
+				name admin
+				path /admin
+				except /admin/public
+				methods POST PUT
+				host admin.example.com
+				simple user=pass on_error=continue,cache=1m
+				upstream url=http://localhost/
+				policy all
+				require group admins
+				failure redirect target=/login
+				mode report_only
+			}`))
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	expect := []string{
+		"name admin",
+		"path /admin",
+		"except /admin/public",
+		"methods POST PUT",
+		"host admin.example.com",
+		"simple on_error=continue,cache",
+		"upstream",
+		"policy all",
+		"on_error deny",
+		"mode report_only",
+		"require group admins",
+		"failure redirect target=/login,code=302",
+		"forbidden status code=403",
+	}
+
+	if actual := sites[0].Rules[0].Describe(); !reflect.DeepEqual(expect, actual) {
+		t.Errorf("Expected %q got %q", expect, actual)
+	}
+}
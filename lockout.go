@@ -0,0 +1,230 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// Lockout defaults
+const (
+	DefaultLockoutUser   = 5
+	DefaultLockoutIP     = 50
+	DefaultLockoutWindow = 15 * time.Minute
+)
+
+// lockout counts failed authentication attempts per username and client ip
+// within a sliding window, rejecting further attempts once a limit is reached.
+// The client ip is taken from the forwarding header of trusted proxies so
+// clients behind a proxy aren't locked out together.
+type lockout struct {
+	userLimit int
+	ipLimit   int
+	window    time.Duration
+	trusted   []*net.IPNet
+	proxies   []*net.IPNet
+	header    string
+
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	lastSweep time.Time
+}
+
+func parseLockout(config string) (*lockout, error) {
+	l := &lockout{
+		userLimit: DefaultLockoutUser,
+		ipLimit:   DefaultLockoutIP,
+		window:    DefaultLockoutWindow,
+		header:    backend.DefaultForwardedHeader,
+		failures:  map[string][]time.Time{},
+	}
+
+	if config == "" {
+		return l, nil
+	}
+
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range options {
+		switch k {
+		case "user":
+			if l.userLimit, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("unable to parse user %s: %v", v, err)
+			}
+		case "ip":
+			if l.ipLimit, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("unable to parse ip %s: %v", v, err)
+			}
+		case "window":
+			if l.window, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("unable to parse window %s: %v", v, err)
+			}
+		case "trusted":
+			if l.trusted, err = backend.ParseNetworks(v); err != nil {
+				return nil, err
+			}
+		case "trusted_proxies":
+			if l.proxies, err = backend.ParseNetworks(v); err != nil {
+				return nil, err
+			}
+		case "forwarded_header":
+			if l.header, err = backend.ParseForwardedHeader(v); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %v", k)
+		}
+	}
+
+	if l.window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+
+	return l, nil
+}
+
+// keys returns the counters that apply to the request, trusted clients have none
+func (l *lockout) keys(r *http.Request) []string {
+	// Addresses that can't be made out are counted together
+	host := "unknown"
+	if ip := backend.ClientIP(r, l.proxies, l.header); ip != nil {
+		if backend.ContainsIP(l.trusted, ip) {
+			return nil
+		}
+		host = ip.String()
+	}
+
+	var keys []string
+	if l.ipLimit > 0 {
+		keys = append(keys, "ip:"+host)
+	}
+	if un, _, ok := r.BasicAuth(); ok && un != "" && l.userLimit > 0 {
+		keys = append(keys, "user:"+un)
+	}
+	return keys
+}
+
+func (l *lockout) limit(key string) int {
+	if strings.HasPrefix(key, "user:") {
+		return l.userLimit
+	}
+	return l.ipLimit
+}
+
+// locked returns true and how long to wait if the request must be rejected
+// without consulting the backends
+func (l *lockout) locked(r *http.Request) (time.Duration, bool) {
+	keys := l.keys(r)
+	if len(keys) == 0 {
+		return 0, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		failures := l.prune(k, now)
+		limit := l.limit(k)
+		if len(failures) < limit {
+			continue
+		}
+		if w := failures[len(failures)-limit].Add(l.window).Sub(now); w > wait {
+			wait = w
+		}
+	}
+
+	return wait, wait > 0
+}
+
+// fail records a failed attempt, requests without credentials aren't counted
+func (l *lockout) fail(r *http.Request) {
+	if r.Header.Get("Authorization") == "" {
+		return
+	}
+
+	keys := l.keys(r)
+	if len(keys) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range keys {
+		l.failures[k] = append(l.prune(k, now), now)
+	}
+
+	if now.Sub(l.lastSweep) > l.window {
+		for k := range l.failures {
+			l.prune(k, now)
+		}
+		l.lastSweep = now
+	}
+}
+
+// succeed forgets the failed attempts of the authenticated user
+func (l *lockout) succeed(r *http.Request) {
+	un, _, ok := r.BasicAuth()
+	if !ok || un == "" {
+		return
+	}
+
+	l.mu.Lock()
+	delete(l.failures, "user:"+un)
+	l.mu.Unlock()
+}
+
+// prune drops failures that have left the window, must be called with the lock held
+func (l *lockout) prune(key string, now time.Time) []time.Time {
+	failures := l.failures[key]
+	i := 0
+	for i < len(failures) && now.Sub(failures[i]) >= l.window {
+		i++
+	}
+	failures = failures[i:]
+
+	if len(failures) == 0 {
+		delete(l.failures, key)
+		return nil
+	}
+
+	l.failures[key] = failures
+	return failures
+}
@@ -0,0 +1,131 @@
+package reauth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	l, err := parseLockout(`user=2,ip=3,window=1m,trusted="10.0.0.0/8,192.168.1.1"`)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	request := func(un, addr string) *http.Request {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		r.SetBasicAuth(un, "wrong")
+		return r
+	}
+
+	t.Log("Testing the user limit")
+	l.fail(request("bob", "203.0.113.1:1234"))
+	if _, locked := l.locked(request("bob", "203.0.113.2:1234")); locked {
+		t.Error("bob shouldn't be locked out yet")
+	}
+	l.fail(request("bob", "203.0.113.2:1234"))
+	wait, locked := l.locked(request("bob", "203.0.113.3:1234"))
+	if !locked {
+		t.Error("bob should be locked out")
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("Expected a wait of up to a minute, got %v", wait)
+	}
+
+	t.Log("Testing success resets the user")
+	l.succeed(request("bob", "203.0.113.3:1234"))
+	if _, locked := l.locked(request("bob", "203.0.113.3:1234")); locked {
+		t.Error("bob shouldn't be locked out after succeeding")
+	}
+
+	t.Log("Testing the ip limit")
+	for _, un := range []string{"alice", "fred", "jane"} {
+		l.fail(request(un, "203.0.113.1:1234"))
+	}
+	if _, locked := l.locked(request("mary", "203.0.113.1:1234")); !locked {
+		t.Error("203.0.113.1 should be locked out")
+	}
+	if _, locked := l.locked(request("mary", "203.0.113.9:1234")); locked {
+		t.Error("mary shouldn't be locked out from another address")
+	}
+
+	t.Log("Testing trusted networks")
+	for i := 0; i < 5; i++ {
+		l.fail(request("sam", "10.1.2.3:1234"))
+		l.fail(request("sam", "192.168.1.1:1234"))
+	}
+	if _, locked := l.locked(request("sam", "10.1.2.3:1234")); locked {
+		t.Error("trusted networks shouldn't be locked out")
+	}
+
+	t.Log("Testing requests without credentials aren't counted")
+	for i := 0; i < 5; i++ {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "203.0.113.50:1234"
+		l.fail(r)
+	}
+	if _, locked := l.locked(request("mary", "203.0.113.50:1234")); locked {
+		t.Error("anonymous requests shouldn't lock out an address")
+	}
+}
+
+func TestLockoutProxies(t *testing.T) {
+	l, err := parseLockout(`user=0,ip=2,trusted=10.1.1.1,trusted_proxies=192.168.1.1`)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	request := func(un, addr, xff string) *http.Request {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("X-Forwarded-For", xff)
+		r.SetBasicAuth(un, "wrong")
+		return r
+	}
+
+	t.Log("Testing clients behind a proxy are counted separately")
+	l.fail(request("alice", "192.168.1.1:1234", "203.0.113.1"))
+	l.fail(request("fred", "192.168.1.1:1234", "203.0.113.1"))
+	if _, locked := l.locked(request("mary", "192.168.1.1:1234", "203.0.113.1")); !locked {
+		t.Error("203.0.113.1 should be locked out")
+	}
+	if _, locked := l.locked(request("mary", "192.168.1.1:1234", "203.0.113.2")); locked {
+		t.Error("203.0.113.2 shouldn't be locked out")
+	}
+
+	t.Log("Testing untrusted forwarding headers are ignored")
+	l.fail(request("alice", "203.0.113.5:1234", "203.0.113.6"))
+	l.fail(request("alice", "203.0.113.5:1234", "203.0.113.7"))
+	if _, locked := l.locked(request("mary", "203.0.113.5:1234", "203.0.113.8")); !locked {
+		t.Error("203.0.113.5 should be locked out")
+	}
+
+	t.Log("Testing trusted clients behind a proxy")
+	l.fail(request("sam", "192.168.1.1:1234", "10.1.1.1"))
+	l.fail(request("sam", "192.168.1.1:1234", "10.1.1.1"))
+	if _, locked := l.locked(request("sam", "192.168.1.1:1234", "10.1.1.1")); locked {
+		t.Error("trusted clients shouldn't be locked out")
+	}
+}
+
+func TestLockoutWindow(t *testing.T) {
+	l, err := parseLockout(`user=1,window=10ms`)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.1:1234"
+	r.SetBasicAuth("bob", "wrong")
+
+	l.fail(r)
+	if _, locked := l.locked(r); !locked {
+		t.Error("bob should be locked out")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, locked := l.locked(r); locked {
+		t.Error("bob should have left the window")
+	}
+}
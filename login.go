@@ -0,0 +1,315 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// DefaultLoginError is shown when a login attempt fails
+const DefaultLoginError = "Invalid username or password"
+
+const defaultLoginTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+<style>
+body { font-family: sans-serif; background: #f4f4f4; }
+form { max-width: 20em; margin: 10vh auto; padding: 2em; background: #fff; border-radius: 4px; }
+label, input { display: block; width: 100%; box-sizing: border-box; }
+input { margin: 0.25em 0 1em; padding: 0.5em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<form method="post" action="{{.Action}}">
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<label for="username">Username</label>
+<input type="text" id="username" name="username" value="{{.Username}}" autofocus required>
+<label for="password">Password</label>
+<input type="password" id="password" name="password" required>
+<input type="submit" value="Sign in">
+</form>
+</body>
+</html>
+`
+
+// loginPage serves a html login form that authenticates against the rule's
+// backends and issues a session
+type loginPage struct {
+	path     string
+	template *template.Template
+	error    string
+}
+
+// loginData is passed to the login template
+type loginData struct {
+	Action   string
+	Redirect string
+	CSRF     string
+	Username string
+	Error    string
+}
+
+func parseLoginPage(config string) (*loginPage, error) {
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &loginPage{error: DefaultLoginError}
+	source := defaultLoginTemplate
+	for k, v := range options {
+		switch k {
+		case "path":
+			l.path = v
+		case "template":
+			b, err := ioutil.ReadFile(v)
+			if err != nil {
+				return nil, err
+			}
+			source = string(b)
+		case "error":
+			l.error = v
+		default:
+			return nil, fmt.Errorf("unknown option %v", k)
+		}
+	}
+
+	if l.path == "" {
+		return nil, errors.New("path is a required parameter")
+	}
+
+	l.template, err = template.New("login").Parse(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// login serves the login page of a rule
+func (h Reauth) login(w http.ResponseWriter, r *http.Request, p Rule) (int, error) {
+	l := p.login
+	csrfName := p.session.name + "_csrf"
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		token, err := csrfToken(w, r, csrfName, p.session)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		return l.render(w, http.StatusOK, loginData{
+			Action:   l.path,
+			Redirect: r.URL.Query().Get("redirect"),
+			CSRF:     token,
+		})
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	c, err := r.Cookie(csrfName)
+	if err != nil || c.Value == "" || subtle.ConstantTimeCompare([]byte(c.Value), []byte(r.PostForm.Get("csrf"))) != 1 {
+		log.Printf("[WARNING] reauth: login from %s failed the csrf check", r.RemoteAddr)
+		return http.StatusForbidden, nil
+	}
+
+	data := loginData{
+		Action:   l.path,
+		Redirect: r.PostForm.Get("redirect"),
+		CSRF:     c.Value,
+		Username: r.PostForm.Get("username"),
+	}
+
+	// Authenticate a copy of the request carrying the submitted credentials
+	// so the backends see them just like http basic credentials
+	ar := r.WithContext(r.Context())
+	ar.Header = cloneHeader(r.Header)
+	ar.SetBasicAuth(data.Username, r.PostForm.Get("password"))
+
+	d := newDecision(ar, p)
+	defer func() {
+		decisions.WithLabelValues(d.rule, d.outcome).Inc()
+		p.audit.record(d)
+	}()
+
+	if p.lockout != nil {
+		if wait, locked := p.lockout.locked(ar); locked {
+			d.decide(outcomeLocked, "too many failed attempts")
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			data.Error = l.error
+			return l.render(w, http.StatusTooManyRequests, data)
+		}
+	}
+
+	res := p.authenticate(ar)
+	d.backends = res.passed
+	if res.err != nil {
+		d.backends = []string{res.backend}
+		d.decide(outcomeError, fmt.Sprintf("backend error: %v", res.err))
+		return http.StatusServiceUnavailable, res.err
+	}
+
+	// A session needs a principal, passing only anonymous backends such as
+	// ip doesn't prove who is logging in
+	id := res.identity
+	if id == nil || id.Username == "" {
+		if p.lockout != nil {
+			p.lockout.fail(ar)
+		}
+		d.decide(outcomeDeny, "rejected by all backends")
+		data.Error = l.error
+		return l.render(w, http.StatusOK, data)
+	}
+
+	// Nor can a session stand in for backends that can't be skipped, such as
+	// ip which would carry its judgement to other clients
+	if res.requestBound {
+		log.Printf("[WARNING] reauth: not issuing a session for %q, %v can't be skipped", id.Username, res.passed)
+		d.decide(outcomeDeny, "identity only holds for this request")
+		data.Error = l.error
+		return l.render(w, http.StatusOK, data)
+	}
+
+	d.username = id.Username
+	if p.lockout != nil {
+		p.lockout.succeed(ar)
+	}
+
+	if !p.require.permits(id) {
+		d.decide(outcomeForbidden, "not permitted")
+		data.Error = l.error
+		return l.render(w, http.StatusForbidden, data)
+	}
+
+	if err := p.session.issue(w, r, id); err != nil {
+		d.decide(outcomeError, fmt.Sprintf("unable to issue session: %v", err))
+		return http.StatusInternalServerError, err
+	}
+
+	d.decide(outcomeAllow, "")
+	target := safeRedirect(r, data.Redirect, p.session.domain)
+	http.Redirect(w, r, target, http.StatusSeeOther)
+	return http.StatusSeeOther, nil
+}
+
+func (l *loginPage) render(w http.ResponseWriter, status int, data loginData) (int, error) {
+	var buf bytes.Buffer
+	if err := l.template.Execute(&buf, data); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+	return 0, nil
+}
+
+// csrfToken returns the request's csrf token, issuing a new one if required
+func csrfToken(w http.ResponseWriter, r *http.Request, name string, s *sessions) (string, error) {
+	if c, err := r.Cookie(name); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	c := s.cookie(r, token, time.Time{})
+	c.Name = name
+	c.SameSite = http.SameSiteStrictMode
+	http.SetCookie(w, c)
+
+	return token, nil
+}
+
+// safeRedirect only permits redirection to the current host or, if sessions
+// are shared across a domain, hosts within that domain
+func safeRedirect(r *http.Request, target, domain string) string {
+	u, err := url.Parse(target)
+	if err != nil || target == "" {
+		return "/"
+	}
+
+	if u.Scheme == "" && u.Host == "" {
+		if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+			return "/"
+		}
+		return target
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "/"
+	}
+
+	host := u.Hostname()
+	if strings.EqualFold(u.Host, r.Host) {
+		return target
+	}
+
+	if domain = strings.TrimPrefix(domain, "."); domain != "" {
+		if strings.EqualFold(host, domain) || strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(domain)) {
+			return target
+		}
+	}
+
+	return "/"
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
@@ -0,0 +1,120 @@
+package reauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+func TestLoginPage(t *testing.T) {
+	c := caddy.NewTestController("http", `reauth {
+		path /
+		simple bob=secret
+		session keys=0123456789abcdef
+		login "path=/login,error=Go away"
+		failure redirect target=/login?redirect={uri}
+	}`)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	h := &Reauth{rules: rules, next: httpserver.HandlerFunc(emptyHandler)}
+
+	t.Log("Testing the form is served")
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/login?redirect=%2Fprivate", nil)
+	if _, err := h.ServeHTTP(rec, r); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("Expected 200, got %d (%v)", rec.Code, err)
+	}
+	if !strings.Contains(rec.Body.String(), `value="/private"`) {
+		t.Error("Expected the redirect to be carried by the form")
+	}
+
+	var csrf *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == DefaultSessionName+"_csrf" {
+			csrf = cookie
+		}
+	}
+	if csrf == nil {
+		t.Fatal("Expected a csrf cookie")
+	}
+
+	post := func(form url.Values, cookie *http.Cookie) (*httptest.ResponseRecorder, int) {
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		status, _ := h.ServeHTTP(rec, r)
+		return rec, status
+	}
+
+	t.Log("Testing posts without a csrf token are rejected")
+	if _, status := post(url.Values{"username": {"bob"}, "password": {"secret"}}, nil); status != http.StatusForbidden {
+		t.Errorf("Expected 403, got %d", status)
+	}
+
+	t.Log("Testing wrong credentials")
+	rec, _ = post(url.Values{"username": {"bob"}, "password": {"wrong"}, "csrf": {csrf.Value}}, csrf)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "Go away") {
+		t.Errorf("Expected the form with an error, got %d", rec.Code)
+	}
+	if len(rec.Result().Cookies()) != 0 {
+		t.Error("Didn't expect a session")
+	}
+
+	t.Log("Testing correct credentials")
+	rec, _ = post(url.Values{"username": {"bob"}, "password": {"secret"}, "csrf": {csrf.Value}, "redirect": {"/private"}}, csrf)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/private" {
+		t.Errorf("Expected a redirect to /private, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != DefaultSessionName {
+		t.Fatalf("Expected a session, got %v", cookies)
+	}
+
+	t.Log("Testing the session grants access")
+	rec = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/private", nil)
+	r.AddCookie(cookies[0])
+	if status, err := h.ServeHTTP(rec, r); status != http.StatusOK || err != nil {
+		t.Errorf("Expected 200, got %d (%v)", status, err)
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := []struct {
+		desc   string
+		target string
+		domain string
+		expect string
+	}{
+		{`Empty`, ``, ``, `/`},
+		{`Relative path`, `/private?a=b`, ``, `/private?a=b`},
+		{`Not a path`, `private`, ``, `/`},
+		{`Protocol relative`, `//evil.com/`, ``, `/`},
+		{`Backslash`, `/\evil.com/`, ``, `/`},
+		{`Same host`, `https://example.com/private`, ``, `https://example.com/private`},
+		{`Other host`, `https://evil.com/`, ``, `/`},
+		{`Within domain`, `https://app.example.com/`, `.example.com`, `https://app.example.com/`},
+		{`Outside domain`, `https://badexample.com/`, `example.com`, `/`},
+		{`Javascript`, `javascript:alert(1)`, ``, `/`},
+	}
+
+	r, _ := http.NewRequest("GET", "https://example.com/login", nil)
+	for i, tc := range tests {
+		t.Logf("Testing redirect %d (%s)", i+1, tc.desc)
+		if actual := safeRedirect(r, tc.target, tc.domain); actual != tc.expect {
+			t.Errorf("Expected %s got %s", tc.expect, actual)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// logoutPage ends sessions and forgets cached credentials before sending
+// the client elsewhere
+type logoutPage struct {
+	path   string
+	target string
+	realm  string
+}
+
+var logoutTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="0; url={{.}}">
+<title>Signed out</title>
+</head>
+<body>
+<p>You have been signed out, <a href="{{.}}">continue</a>.</p>
+</body>
+</html>
+`))
+
+func parseLogoutPage(config string) (*logoutPage, error) {
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &logoutPage{target: "/"}
+	for k, v := range options {
+		switch k {
+		case "path":
+			l.path = v
+		case "target":
+			l.target = v
+		case "realm":
+			l.realm = v
+		default:
+			return nil, fmt.Errorf("unknown option %v", k)
+		}
+	}
+
+	if l.path == "" {
+		return nil, errors.New("path is a required parameter")
+	}
+
+	return l, nil
+}
+
+// logout revokes the session, purges cached results for the identity and
+// redirects to the target. Browsers only forget basic credentials when they
+// are challenged again so if a realm is configured the redirect is made from
+// the body of a 401 instead.
+func (h Reauth) logout(w http.ResponseWriter, r *http.Request, p Rule) (int, error) {
+	l := p.logout
+
+	var username string
+	if p.session != nil {
+		if id := p.session.revoke(w, r); id != nil {
+			username = id.Username
+		}
+	}
+	if username == "" {
+		username = p.verifiedUsername(r)
+	}
+
+	if username != "" {
+		for _, rb := range p.backends {
+			if c, ok := rb.Backend.(*backend.Cache); ok {
+				c.Purge(username)
+			}
+		}
+		log.Printf("[INFO] reauth: %q logged out of %s", username, p.label())
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if l.realm == "" {
+		http.Redirect(w, r, l.target, http.StatusSeeOther)
+		return http.StatusSeeOther, nil
+	}
+
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", l.realm))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	logoutTemplate.Execute(w, l.target)
+	return 0, nil
+}
+
+// verifiedUsername returns the username of the credentials presented with the
+// request once the rule's backends have accepted them, purging for whoever the
+// client claims to be would let anyone flush another user's cached results
+func (p Rule) verifiedUsername(r *http.Request) string {
+	if _, _, ok := r.BasicAuth(); !ok {
+		return ""
+	}
+
+	if p.lockout != nil {
+		if _, locked := p.lockout.locked(r); locked {
+			return ""
+		}
+	}
+
+	res := p.authenticate(r)
+	if res.err != nil || res.identity == nil {
+		if p.lockout != nil && res.err == nil {
+			p.lockout.fail(r)
+		}
+		return ""
+	}
+
+	if p.lockout != nil {
+		p.lockout.succeed(r)
+	}
+	return res.identity.Username
+}
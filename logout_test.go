@@ -0,0 +1,150 @@
+package reauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+func TestMiddlewareLogout(t *testing.T) {
+	test := `reauth {
+				path /test
+				session keys="0123456789abcdef"
+				logout path=/logout,target=/bye
+				simple username=password cache=1m
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+	cache := rules[0].backends[0].Backend.(*backend.Cache)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.SetBasicAuth("username", "password")
+	rec := httptest.NewRecorder()
+	if result, _ := auth.ServeHTTP(rec, req); result != http.StatusOK {
+		t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
+	}
+	session := rec.Result().Cookies()[0]
+	if cache.Len() != 1 {
+		t.Errorf("Expected a cached result, got %d", cache.Len())
+	}
+
+	t.Log("Testing logout")
+	req, _ = http.NewRequest("GET", "/logout", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	if result, _ := auth.ServeHTTP(rec, req); result != http.StatusSeeOther {
+		t.Errorf("Expected `%v` got `%v`", http.StatusSeeOther, result)
+	}
+	if location := rec.Header().Get("Location"); location != "/bye" {
+		t.Errorf("Expected a redirect to /bye got %s", location)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+		t.Errorf("Expected the session cookie to be cleared, got %v", cookies)
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Expected the cache to be purged, got %d", cache.Len())
+	}
+
+	t.Log("Testing the session was revoked")
+	req, _ = http.NewRequest("GET", "/test", nil)
+	req.AddCookie(session)
+	if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusUnauthorized {
+		t.Errorf("Expected `%v` got `%v`", http.StatusUnauthorized, result)
+	}
+}
+
+func TestMiddlewareLogoutBasic(t *testing.T) {
+	test := `reauth {
+				path /test
+				logout path=/logout
+				simple username=password,other=secret cache=1m
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+	cache := rules[0].backends[0].Backend.(*backend.Cache)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.SetBasicAuth("username", "password")
+	if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusOK {
+		t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
+	}
+
+	tests := []struct {
+		desc     string
+		username string
+		password string
+		cached   int
+	}{
+		{"unverified credentials", "username", "wrong", 1},
+		{"another user's credentials", "other", "secret", 1},
+		{"verified credentials", "username", "password", 0},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing logout %d (%s)", i+1, tc.desc)
+		req, _ = http.NewRequest("GET", "/logout", nil)
+		req.SetBasicAuth(tc.username, tc.password)
+		if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusSeeOther {
+			t.Errorf("Expected `%v` got `%v`", http.StatusSeeOther, result)
+		}
+		if n := cache.Len(); n != tc.cached {
+			t.Errorf("Expected %d cached results got %d", tc.cached, n)
+		}
+	}
+}
+
+func TestMiddlewareLogoutRealm(t *testing.T) {
+	test := `reauth {
+				path /test
+				logout path=/logout,realm=goodbye
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	req, _ := http.NewRequest("GET", "/logout", nil)
+	req.SetBasicAuth("username", "password")
+	rec := httptest.NewRecorder()
+	auth.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected `%v` got `%v`", http.StatusUnauthorized, rec.Code)
+	}
+	if challenge := rec.Header().Get("WWW-Authenticate"); challenge != `Basic realm="goodbye"` {
+		t.Errorf("Unexpected challenge %s", challenge)
+	}
+	if !strings.Contains(rec.Body.String(), `url=/`) {
+		t.Errorf("Expected a redirect to / in the body, got %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,284 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// matches returns true if the rule protects the request
+func (p Rule) matches(r *http.Request) bool {
+	if !p.matchesMethod(r.Method) || !p.matchesHost(r.Host) {
+		return false
+	}
+
+	if !matchesPath(r.URL.Path, p.path, p.pathPatterns) {
+		return false
+	}
+
+	return !matchesPath(r.URL.Path, p.exceptions, p.exceptPatterns)
+}
+
+// ruleFor returns the most specific rule of the given mode protecting the
+// request, the rule with the longest matching path wins and rules restricted
+// to hosts win over those that aren't, otherwise the first declared rule wins.
+// Enforcing and report only rules are chosen separately so trying out a rule
+// never takes a request away from the rule that protects it.
+func (h Reauth) ruleFor(r *http.Request, reportOnly bool) (Rule, bool) {
+	var (
+		best     Rule
+		found    bool
+		bestLen  int
+		bestHost bool
+	)
+
+	for _, p := range h.rules {
+		if p.reportOnly != reportOnly || !p.matches(r) {
+			continue
+		}
+
+		n, host := specificity(r.URL.Path, p.path, p.pathPatterns), len(p.hosts) > 0
+		if !found || n > bestLen || (n == bestLen && host && !bestHost) {
+			best, found, bestLen, bestHost = p, true, n, host
+		}
+	}
+
+	return best, found
+}
+
+// specificity returns the length of the longest prefix matching the path,
+// patterns are ranked by their literal prefix
+func specificity(path string, prefixes []string, patterns []*regexp.Regexp) int {
+	n := -1
+	for _, pp := range prefixes {
+		if len(pp) > n && httpserver.Path(path).Matches(pp) {
+			n = len(pp)
+		}
+	}
+
+	for _, re := range patterns {
+		if prefix, _ := re.LiteralPrefix(); len(prefix) > n && re.MatchString(path) {
+			n = len(prefix)
+		}
+	}
+
+	return n
+}
+
+// matchesPath returns true if the path has one of the prefixes or matches one of the patterns
+func matchesPath(path string, prefixes []string, patterns []*regexp.Regexp) bool {
+	for _, pp := range prefixes {
+		if httpserver.Path(path).Matches(pp) {
+			return true
+		}
+	}
+
+	for _, re := range patterns {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compileGlob converts a glob into an anchored regular expression, * matches
+// within a single path segment, ** matches across segments and ? matches any
+// single character other than /
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// matchesMethod returns true if requests with the given method are protected
+func (p Rule) matchesMethod(method string) bool {
+	method = strings.ToUpper(method)
+	if containsString(p.getMethods, method) {
+		method = http.MethodGet
+	}
+
+	if len(p.methods) > 0 && !containsString(p.methods, method) {
+		return false
+	}
+
+	return !containsString(p.exceptMethods, method)
+}
+
+// matchesHost returns true if requests for the given host are protected
+func (p Rule) matchesHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if len(p.hosts) > 0 && !matchesHostPattern(host, p.hosts) {
+		return false
+	}
+
+	return !matchesHostPattern(host, p.exceptHosts)
+}
+
+// matchesHostPattern returns true if the host matches one of the patterns,
+// wildcards match within a single label so *.example.com matches
+// www.example.com but not example.com or a.b.example.com
+func matchesHostPattern(host string, patterns []string) bool {
+	labels := strings.Split(host, ".")
+
+next:
+	for _, pattern := range patterns {
+		parts := strings.Split(pattern, ".")
+		if len(parts) != len(labels) {
+			continue
+		}
+		for i := range parts {
+			if ok, _ := path.Match(parts[i], labels[i]); !ok {
+				continue next
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// warnUnreachable logs a warning for every rule that can never be chosen
+func warnUnreachable(rules []Rule) {
+	for i, p := range rules {
+		if reason := p.unreachable(rules[:i]); reason != "" {
+			log.Printf("[WARNING] reauth: rule %s can never match, %s", p.label(), reason)
+		}
+	}
+}
+
+// unreachable explains why the rule can never be chosen given the rules
+// declared before it, or returns an empty string
+func (p Rule) unreachable(earlier []Rule) string {
+	if len(p.pathPatterns) == 0 && len(p.exceptPatterns) == 0 {
+		excepted := true
+		for _, pp := range p.path {
+			if !matchesPath(pp, p.exceptions, nil) {
+				excepted = false
+			}
+		}
+		if excepted {
+			return "every path is excepted"
+		}
+	}
+
+	if len(p.methods) > 0 {
+		excepted := true
+		for _, m := range p.methods {
+			if !containsString(p.exceptMethods, m) {
+				excepted = false
+			}
+		}
+		if excepted {
+			return "every method is excepted"
+		}
+	}
+
+	if len(p.hosts) > 0 {
+		excepted := true
+		for _, h := range p.hosts {
+			if !containsString(p.exceptHosts, h) {
+				excepted = false
+			}
+		}
+		if excepted {
+			return "every host is excepted"
+		}
+	}
+
+	for _, e := range earlier {
+		if p.reportOnly == e.reportOnly && p.sameMatch(e) {
+			return "it matches exactly the same requests as " + e.label()
+		}
+	}
+
+	return ""
+}
+
+// sameMatch returns true if both rules match exactly the same requests
+func (p Rule) sameMatch(o Rule) bool {
+	patterns := func(res []*regexp.Regexp) []string {
+		var s []string
+		for _, re := range res {
+			s = append(s, re.String())
+		}
+		return s
+	}
+
+	return sameStrings(p.path, o.path) &&
+		sameStrings(p.exceptions, o.exceptions) &&
+		sameStrings(patterns(p.pathPatterns), patterns(o.pathPatterns)) &&
+		sameStrings(patterns(p.exceptPatterns), patterns(o.exceptPatterns)) &&
+		sameStrings(p.methods, o.methods) &&
+		sameStrings(p.exceptMethods, o.exceptMethods) &&
+		sameStrings(p.getMethods, o.getMethods) &&
+		sameStrings(p.hosts, o.hosts) &&
+		sameStrings(p.exceptHosts, o.exceptHosts)
+}
+
+// sameStrings returns true if both contain the same strings in any order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, s := range a {
+		if !containsString(b, s) {
+			return false
+		}
+	}
+	for _, s := range b {
+		if !containsString(a, s) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package reauth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		glob   string
+		path   string
+		expect bool
+	}{
+		{`/api/*/health`, `/api/users/health`, true},
+		{`/api/*/health`, `/api/users/health/more`, false},
+		{`/api/*/health`, `/api/users/v1/health`, false},
+		{`/v2/*/manifests/*`, `/v2/image/manifests/latest`, true},
+		{`/v2/**/manifests/*`, `/v2/group/image/manifests/latest`, true},
+		{`/v2/**/manifests/*`, `/v2/group/image/blobs/sha256`, false},
+		{`/file.?`, `/file.a`, true},
+		{`/file.?`, `/fileba`, false},
+		{`/static/**`, `/static/css/site.css`, true},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing glob %d (%s against %s)", i+1, tc.glob, tc.path)
+		re, err := compileGlob(tc.glob)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+			continue
+		}
+		if got := re.MatchString(tc.path); got != tc.expect {
+			t.Errorf("Expected %v got %v", tc.expect, got)
+		}
+	}
+}
+
+func TestMatchesHost(t *testing.T) {
+	p := Rule{hosts: []string{`*.example.com`, `example.org`}, exceptHosts: []string{`www.example.com`}}
+
+	tests := []struct {
+		host   string
+		expect bool
+	}{
+		{`admin.example.com`, true},
+		{`Admin.Example.com:8443`, true},
+		{`admin.example.com.`, true},
+		{`www.example.com`, false},
+		{`example.com`, false},
+		{`a.b.example.com`, false},
+		{`example.org`, true},
+		{`www.example.org`, false},
+		{`[::1]:443`, false},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing host %d (%s)", i+1, tc.host)
+		if got := p.matchesHost(tc.host); got != tc.expect {
+			t.Errorf("Expected %v got %v", tc.expect, got)
+		}
+	}
+
+	if !(Rule{}).matchesHost(`anything.example.net`) {
+		t.Error("Expected rules without hosts to match every host")
+	}
+}
+
+func TestRuleFor(t *testing.T) {
+	c := caddy.NewTestController("http", `reauth {
+				name everything
+				path /
+				simple username=password
+			}
+			reauth {
+				name admin
+				path /admin
+				except /admin/public
+				simple username=password
+			}
+			reauth {
+				name reports
+				path_glob /admin/*/reports
+				simple username=password
+			}
+			reauth {
+				name admin-host
+				path /
+				host admin.example.com
+				simple username=password
+			}`)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+	h := Reauth{rules: rules}
+
+	for uri, expect := range map[string]string{
+		"http://example.com/":                   "everything",
+		"http://example.com/admin/users":        "admin",
+		"http://example.com/admin/public/x":     "everything",
+		"http://example.com/admin/2019/reports": "reports",
+		"http://admin.example.com/":             "admin-host",
+		"http://admin.example.com/admin":        "admin",
+	} {
+		r, _ := http.NewRequest("GET", uri, nil)
+		p, ok := h.ruleFor(r, false)
+		if !ok {
+			t.Errorf("Expected a rule for %s", uri)
+		} else if p.name != expect {
+			t.Errorf("Expected rule %s for %s got %s", expect, uri, p.name)
+		}
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config string
+		expect string
+	}{
+		{
+			`Reachable`,
+			`reauth {
+				path /admin
+				except /admin/public
+				simple username=password
+			}`,
+			``,
+		}, {
+			`Every path excepted`,
+			`reauth {
+				path /admin
+				except /
+				simple username=password
+			}`,
+			`every path is excepted`,
+		}, {
+			`Every method excepted`,
+			`reauth {
+				path /
+				methods POST PUT
+				except_methods PUT POST
+				simple username=password
+			}`,
+			`every method is excepted`,
+		}, {
+			`Every host excepted`,
+			`reauth {
+				path /
+				host example.com
+				except_host example.com
+				simple username=password
+			}`,
+			`every host is excepted`,
+		}, {
+			`Shadowed`,
+			`reauth {
+				path /a
+				path /b
+				simple username=password
+			}
+			reauth {
+				path /b
+				path /a
+				simple other=password
+			}`,
+			`it matches exactly the same requests as /a,/b`,
+		},
+		{
+			`Report only copy of an enforcing rule`,
+			`reauth {
+				path /a
+				simple username=password
+			}
+			reauth {
+				path /a
+				mode report_only
+				simple other=password
+			}`,
+			``,
+		},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing unreachable %d (%s)", i+1, tc.desc)
+		rules, err := parseConfiguration(caddy.NewTestController("http", tc.config))
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+			continue
+		}
+		last := len(rules) - 1
+		if reason := rules[last].unreachable(rules[:last]); reason != tc.expect {
+			t.Errorf("Expected `%v` got `%v`", tc.expect, reason)
+		}
+	}
+}
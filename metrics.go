@@ -0,0 +1,108 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "caddy"
+	metricsSubsystem = "reauth"
+)
+
+var (
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "backend_duration_seconds",
+		Help:      "Time taken by backends to authenticate requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"rule", "backend"})
+
+	backendResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "backend_results_total",
+		Help:      "Authentication results by rule, backend and result (success, deny or error).",
+	}, []string{"rule", "backend", "result"})
+
+	decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "decisions_total",
+		Help:      "Decisions about protected requests by rule and outcome.",
+	}, []string{"rule", "outcome"})
+
+	reportOnlyDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "report_only_decisions_total",
+		Help:      "Decisions that would have been made by report only rules by rule and outcome.",
+	}, []string{"rule", "outcome"})
+
+	failureHandlerCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: metricsSubsystem,
+		Name:      "failure_handler_total",
+		Help:      "Failure handler invocations by rule, path (failure or forbidden) and handler type.",
+	}, []string{"rule", "path", "handler"})
+)
+
+func init() {
+	prometheus.MustRegister(backendDuration, backendResults, decisions, reportOnlyDecisions, failureHandlerCalls)
+}
+
+// promHandler serves the default registry, it's built once as every handler
+// instruments itself with counters of its own
+var promHandler = promhttp.Handler()
+
+var metricsHandler = httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+	promHandler.ServeHTTP(w, r)
+	return 0, nil
+})
+
+// failureType names a failure handler for metrics
+func failureType(f failure) string {
+	switch f.(type) {
+	case *httpBasicOnFailure:
+		return "basicauth"
+	case *httpRedirectOnFailure:
+		return "redirect"
+	case *httpStatusOnFailure:
+		return "status"
+	}
+	return "unknown"
+}
+
+// handleFailure counts and invokes a failure handler
+func handleFailure(rule, path string, f failure, w http.ResponseWriter, r *http.Request) (int, error) {
+	failureHandlerCalls.WithLabelValues(rule, path, failureType(f)).Inc()
+	return f.Handle(w, r)
+}
@@ -0,0 +1,109 @@
+package reauth
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// metricsRuns keeps the rule name unique to each run as the metrics are
+// registered globally and outlive the test, see go test -count
+var metricsRuns int
+
+func TestMiddlewareMetrics(t *testing.T) {
+	metricsRuns++
+	rule := fmt.Sprintf("metrics-test-%d", metricsRuns)
+
+	test := `reauth {
+				name ` + rule + `
+				path /test
+				metrics /metrics
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	for _, pw := range []string{"password", "wrong"} {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.SetBasicAuth("username", pw)
+		auth.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	if _, err := auth.ServeHTTP(rec, req); err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	}
+
+	body := rec.Body.String()
+	for _, expect := range []string{
+		`caddy_reauth_decisions_total{outcome="allow",rule="` + rule + `"} 1`,
+		`caddy_reauth_decisions_total{outcome="deny",rule="` + rule + `"} 1`,
+		`caddy_reauth_backend_results_total{backend="simple",result="success",rule="` + rule + `"} 1`,
+		`caddy_reauth_backend_results_total{backend="simple",result="deny",rule="` + rule + `"} 1`,
+		`caddy_reauth_backend_duration_seconds_count{backend="simple",rule="` + rule + `"} 2`,
+		`caddy_reauth_failure_handler_total{handler="basicauth",path="failure",rule="` + rule + `"} 1`,
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("Expected metrics to contain `%s`", expect)
+		}
+	}
+}
+
+func TestMiddlewareMetricsBreakers(t *testing.T) {
+	test := `reauth {
+				path /first
+				metrics /metrics
+				simple username=password breaker=3
+				simple username=other breaker=3
+			}
+			reauth {
+				path /second
+				simple username=password breaker=3
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	if _, err := auth.ServeHTTP(rec, req); err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	}
+
+	body := rec.Body.String()
+	for _, expect := range []string{
+		`caddy_reauth_breaker_state{backend="simple#1 in /first"} 0`,
+		`caddy_reauth_breaker_state{backend="simple#2 in /first"} 0`,
+		`caddy_reauth_breaker_state{backend="simple#1 in /second"} 0`,
+	} {
+		if !strings.Contains(body, expect) {
+			t.Errorf("Expected metrics to contain `%s`", expect)
+		}
+	}
+	if strings.Contains(body, `caddy_reauth_breaker_state{backend=""}`) {
+		t.Error("Expected no breaker without a name")
+	}
+}
@@ -0,0 +1,92 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	errorDeny = iota
+	errorContinue
+	errorFail
+	errorOpen
+)
+
+var errorModes = map[string]int{
+	"deny":     errorDeny,
+	"continue": errorContinue,
+	"fail":     errorFail,
+	"open":     errorOpen,
+}
+
+// errorPolicy decides what happens when a backend returns an error
+type errorPolicy struct {
+	mode       int
+	retryAfter time.Duration
+}
+
+func parseErrorPolicy(mode, retryAfter string) (errorPolicy, error) {
+	m, ok := errorModes[mode]
+	if !ok {
+		return errorPolicy{}, errors.New("unknown error mode " + mode)
+	}
+
+	e := errorPolicy{mode: m}
+	if retryAfter != "" {
+		if m != errorDeny {
+			return e, errors.New("retry after is only supported by deny")
+		}
+		d, err := time.ParseDuration(retryAfter)
+		if err != nil {
+			return e, err
+		}
+		e.retryAfter = d
+	}
+
+	return e, nil
+}
+
+func (e errorPolicy) String() string {
+	for n, m := range errorModes {
+		if m == e.mode {
+			return n
+		}
+	}
+	return "unknown"
+}
+
+// deny responds with 503 and a Retry-After header if configured, otherwise 500
+func (e errorPolicy) deny(w http.ResponseWriter, err error) (int, error) {
+	if e.retryAfter > 0 {
+		// Rounded up so a fraction of a second doesn't become "retry now"
+		w.Header().Set("Retry-After", strconv.Itoa(int((e.retryAfter+time.Second-1)/time.Second)))
+		return http.StatusServiceUnavailable, err
+	}
+	return http.StatusInternalServerError, err
+}
@@ -0,0 +1,341 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+const (
+	policyAny = iota
+	policyAll
+	policyQuorum
+)
+
+// policy decides how many of a rule's backends must pass
+type policy struct {
+	kind   int
+	quorum int
+}
+
+func parsePolicy(s string) (policy, error) {
+	switch {
+	case s == "any":
+		return policy{kind: policyAny}, nil
+	case s == "all":
+		return policy{kind: policyAll}, nil
+	case strings.HasPrefix(s, "quorum="):
+		n, err := strconv.Atoi(strings.TrimPrefix(s, "quorum="))
+		if err != nil {
+			return policy{}, err
+		}
+		if n < 1 {
+			return policy{}, errors.New("quorum must be at least 1")
+		}
+		return policy{kind: policyQuorum, quorum: n}, nil
+	}
+	return policy{}, errors.New("unknown policy " + s)
+}
+
+// required returns how many of n backends must pass
+func (p policy) required(n int) int {
+	switch p.kind {
+	case policyAll:
+		return n
+	case policyQuorum:
+		return p.quorum
+	}
+	return 1
+}
+
+func (p policy) String() string {
+	switch p.kind {
+	case policyAll:
+		return "all"
+	case policyQuorum:
+		return "quorum=" + strconv.Itoa(p.quorum)
+	}
+	return "any"
+}
+
+// ruleBackend is a configured backend, the name it was configured with and
+// any overrides of the rule's settings
+type ruleBackend struct {
+	name    string
+	onError *errorPolicy
+	breaker *backend.Breaker
+	backend.Backend
+}
+
+// result is the outcome of evaluating a rule's backends
+type result struct {
+	// identity is the merged identity of the backends that passed, nil if the
+	// policy wasn't satisfied
+	identity *backend.Identity
+	// passed holds the names of the backends that passed
+	passed []string
+	// requestBound is set when one of the backends that passed can't be
+	// skipped on later requests, because it judged the client rather than its
+	// credentials, such as ip, or because it changes the request, so the
+	// identity only holds for this request
+	requestBound bool
+	// err is the backend error that ended the evaluation, if any, to be
+	// handled according to onError
+	err     error
+	onError errorPolicy
+	backend string
+}
+
+// attempt is the outcome of a single backend
+type attempt struct {
+	identity *backend.Identity
+	err      error
+}
+
+// authenticate evaluates the rule's backends according to its policy
+func (p Rule) authenticate(r *http.Request) result {
+	// Backends give up once the client goes away or the rule's time is up
+	ctx := r.Context()
+	if p.authTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.authTimeout)
+		defer cancel()
+	}
+
+	if p.parallel && len(p.backends) > 1 {
+		return p.authenticateParallel(ctx, r)
+	}
+
+	var res result
+	for i, b := range p.backends {
+		if p.fold(&res, i, b, p.try(ctx, r, b)) {
+			break
+		}
+	}
+
+	return p.settle(res)
+}
+
+// authenticateParallel asks every backend at once, the request is accepted
+// as soon as enough have passed and the rest are cancelled. Otherwise every
+// backend is waited for and the results are considered in the order the
+// backends were configured so errors are handled just as they would be one
+// after another.
+//
+// Each backend gets its own copy of the request since the ones still running
+// once the request is accepted would otherwise race with the handlers that
+// follow. Form values set by the backends that passed are copied back.
+func (p Rule) authenticateParallel(ctx context.Context, r *http.Request) result {
+	need := p.policy.required(len(p.backends))
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type indexed struct {
+		i int
+		r *http.Request
+		attempt
+	}
+
+	done := make(chan indexed, len(p.backends))
+	for i, b := range p.backends {
+		go func(i int, b ruleBackend, r *http.Request) {
+			done <- indexed{i, r, p.try(ctx, r, b)}
+		}(i, b, r.Clone(ctx))
+	}
+
+	attempts := make([]*attempt, len(p.backends))
+	requests := make([]*http.Request, len(p.backends))
+	var passed int
+	for range p.backends {
+		a := <-done
+		attempts[a.i] = &a.attempt
+		requests[a.i] = a.r
+		if a.err == nil && a.identity != nil {
+			if passed++; passed >= need {
+				cancel()
+				break
+			}
+		}
+	}
+
+	var res result
+	if passed >= need {
+		for i, b := range p.backends {
+			if a := attempts[i]; a != nil && a.err == nil && a.identity != nil {
+				res.passed = append(res.passed, b.name)
+				res.identity = mergeIdentity(res.identity, a.identity)
+				res.requestBound = res.requestBound || backend.IsUncacheable(b.Backend)
+				copyForm(r, requests[i])
+			}
+		}
+		return res
+	}
+
+	for _, c := range requests {
+		copyForm(r, c)
+	}
+
+	for i, b := range p.backends {
+		if p.fold(&res, i, b, *attempts[i]) {
+			break
+		}
+	}
+
+	return p.settle(res)
+}
+
+// copyForm copies the form values a backend set on its copy of the request
+func copyForm(r, c *http.Request) {
+	if c.Form == nil {
+		return
+	}
+	if r.Form == nil {
+		r.Form, r.PostForm = c.Form, c.PostForm
+		return
+	}
+	for k, v := range c.Form {
+		r.Form[k] = v
+	}
+}
+
+// try authenticates the request against a single backend, recording metrics
+// and logging errors
+func (p Rule) try(ctx context.Context, r *http.Request, b ruleBackend) attempt {
+	rule := p.label()
+
+	start := time.Now()
+	id, err := backend.IdentifyContext(ctx, b.Backend, r)
+	backendDuration.WithLabelValues(rule, b.name).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil && ctx.Err() == context.Canceled:
+		backendResults.WithLabelValues(rule, b.name, "cancelled").Inc()
+		return attempt{err: err}
+	case err != nil:
+		backendResults.WithLabelValues(rule, b.name, "error").Inc()
+		log.Printf("[WARNING] reauth: backend %s failed for %s (on_error %v): %v", b.name, r.URL.Path, p.errorPolicy(b), err)
+	case id != nil:
+		backendResults.WithLabelValues(rule, b.name, "success").Inc()
+	default:
+		backendResults.WithLabelValues(rule, b.name, "deny").Inc()
+	}
+
+	return attempt{identity: id, err: err}
+}
+
+// fold adds the attempt of the i'th backend to the result, returning true
+// once the evaluation is over, either because of an error or because the
+// policy is satisfied
+func (p Rule) fold(res *result, i int, b ruleBackend, a attempt) bool {
+	need := p.policy.required(len(p.backends))
+
+	if a.err != nil {
+		onError := p.errorPolicy(b)
+		if onError.mode != errorContinue {
+			res.err = a.err
+			res.onError = onError
+			res.backend = b.name
+			return true
+		}
+	}
+	if a.identity != nil && a.err == nil {
+		res.passed = append(res.passed, b.name)
+		res.identity = mergeIdentity(res.identity, a.identity)
+		res.requestBound = res.requestBound || backend.IsUncacheable(b.Backend)
+		if len(res.passed) >= need {
+			return true
+		}
+	}
+
+	// Stop if there aren't enough backends left to satisfy the policy
+	return len(res.passed)+len(p.backends)-i-1 < need
+}
+
+// settle drops the identity of a result that didn't satisfy the policy
+func (p Rule) settle(res result) result {
+	if res.err != nil || len(res.passed) < p.policy.required(len(p.backends)) {
+		res.identity = nil
+	}
+	return res
+}
+
+// errorPolicy returns the error policy for a backend of the rule
+func (p Rule) errorPolicy(b ruleBackend) errorPolicy {
+	if b.onError != nil {
+		return *b.onError
+	}
+	return p.onError
+}
+
+// mergeIdentity combines the identities reported by multiple backends, the
+// first username and claim values win and groups are combined.
+func mergeIdentity(a, b *backend.Identity) *backend.Identity {
+	if a == nil {
+		return b
+	}
+
+	m := &backend.Identity{
+		Username: a.Username,
+		Groups:   append([]string{}, a.Groups...),
+		Claims:   map[string]string{},
+	}
+
+	if m.Username == "" {
+		m.Username = b.Username
+	}
+
+	for _, g := range b.Groups {
+		if !containsString(m.Groups, g) {
+			m.Groups = append(m.Groups, g)
+		}
+	}
+
+	for k, v := range b.Claims {
+		m.Claims[k] = v
+	}
+	for k, v := range a.Claims {
+		m.Claims[k] = v
+	}
+
+	return m
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -25,12 +25,22 @@
 package reauth
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
 )
 
+// BackendsCtxKey is the context key for the names ([]string) of the backends
+// that authenticated a request
+const BackendsCtxKey caddy.CtxKey = "reauth_backends"
+
 // Reauth is the main package structure containing all the goodies a good
 // structure needs to live a honest life
 type Reauth struct {
@@ -65,35 +75,140 @@ func setup(c *caddy.Controller) error {
 
 // ServeHTTP implements the handler interface for Caddy's middleware
 func (h Reauth) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-RULE:
 	for _, p := range h.rules {
-		protecting := false
-		for _, pp := range p.path {
-			if httpserver.Path(r.URL.Path).Matches(pp) {
-				protecting = true
-				break
-			}
+		p.headers.strip(r)
+		for _, hu := range p.headersUp {
+			r.Header.Del(hu.name)
 		}
-		if !protecting {
+	}
+
+	for _, p := range h.rules {
+		if !p.matchesHost(r.Host) {
 			continue
 		}
-		for _, e := range p.exceptions {
-			if httpserver.Path(r.URL.Path).Matches(e) {
-				continue RULE
-			}
+		if p.login != nil && r.URL.Path == p.login.path {
+			return h.login(w, r, p)
 		}
-		for _, b := range p.backends {
-			ok, err := b.Authenticate(r)
-			if err != nil {
-				return http.StatusInternalServerError, err
-			}
-			if ok {
-				return h.next.ServeHTTP(w, r)
+		if p.logout != nil && r.URL.Path == p.logout.path {
+			return h.logout(w, r, p)
+		}
+		if p.authEndpoint != "" && r.URL.Path == p.authEndpoint {
+			return h.verify(w, r, p)
+		}
+	}
+
+	if p, ok := h.ruleFor(r, true); ok {
+		h.evaluate(r, p)
+	}
+
+	if p, ok := h.ruleFor(r, false); ok {
+		return h.protect(w, r, p)
+	}
+
+	return h.nextFor(r).ServeHTTP(w, r)
+}
+
+// nextFor returns the handler for requests that have been let through, the
+// metrics handler if the path is a configured metrics path
+func (h Reauth) nextFor(r *http.Request) httpserver.Handler {
+	for _, p := range h.rules {
+		if p.metricsPath != "" && r.URL.Path == p.metricsPath {
+			return metricsHandler
+		}
+	}
+	return h.next
+}
+
+// protect authenticates and authorises a request against the rule protecting it
+func (h Reauth) protect(w http.ResponseWriter, r *http.Request, p Rule) (int, error) {
+	d := newDecision(r, p)
+	defer func() {
+		if d.reportOnly {
+			d.report()
+		} else {
+			decisions.WithLabelValues(d.rule, d.outcome).Inc()
+		}
+		p.audit.record(d)
+	}()
+
+	if p.session != nil {
+		if id, ok := p.session.identity(w, r); ok {
+			d.backends = []string{sessionBackend}
+			return h.authorized(w, r, p, d, id)
+		}
+	}
+
+	if p.lockout != nil {
+		if wait, locked := p.lockout.locked(r); locked {
+			log.Printf("[WARNING] reauth: too many failed attempts from %s for %s", r.RemoteAddr, r.URL.Path)
+			d.decide(outcomeLocked, "too many failed attempts")
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+			return http.StatusTooManyRequests, nil
+		}
+	}
+
+	res := p.authenticate(r)
+	d.backends = res.passed
+	if res.err != nil {
+		d.backends = []string{res.backend}
+		reason := fmt.Sprintf("backend error (on_error %v): %v", res.onError, res.err)
+		switch res.onError.mode {
+		case errorFail:
+			d.decide(outcomeDeny, reason)
+			return handleFailure(d.rule, "failure", p.onfail, w, r)
+		case errorOpen:
+			d.decide(outcomeAllow, reason)
+			p.credentials.apply(r)
+			return h.nextFor(r).ServeHTTP(w, r)
+		}
+		d.decide(outcomeError, reason)
+		return res.onError.deny(w, res.err)
+	}
+
+	if id := res.identity; id != nil {
+		if p.lockout != nil {
+			p.lockout.succeed(r)
+		}
+
+		// Anonymous identities, and those that relied on backends that can't
+		// be skipped such as ip, are tied to the request and mustn't outlive
+		// it in a session
+		if p.session != nil && id.Username != "" && !res.requestBound && p.require.permits(id) {
+			if err := p.session.issue(w, r, id); err != nil {
+				log.Printf("[ERROR] reauth: unable to issue session for %q: %v", id.Username, err)
 			}
 		}
 
-		return p.onfail.Handle(w, r)
+		return h.authorized(w, r, p, d, id)
+	}
+
+	reason := "rejected by all backends"
+	if len(res.passed) > 0 {
+		log.Printf("[INFO] reauth: policy %v not satisfied for %s, passed %v", p.policy, r.URL.Path, res.passed)
+		reason = fmt.Sprintf("policy %v not satisfied", p.policy)
+	}
+
+	if p.lockout != nil {
+		p.lockout.fail(r)
+	}
+
+	d.decide(outcomeDeny, reason)
+	return handleFailure(d.rule, "failure", p.onfail, w, r)
+}
+
+// authorized checks the requirements of the rule against an authenticated
+// identity and passes permitted requests on
+func (h Reauth) authorized(w http.ResponseWriter, r *http.Request, p Rule, d *decision, id *backend.Identity) (int, error) {
+	d.username = id.Username
+	if !p.require.permits(id) {
+		log.Printf("[INFO] reauth: %q is not permitted to access %s", id.Username, r.URL.Path)
+		d.decide(outcomeForbidden, "not permitted")
+		return handleFailure(d.rule, "forbidden", p.forbidden, w, r)
 	}
 
-	return h.next.ServeHTTP(w, r)
+	d.decide(outcomeAllow, "")
+	setHeadersUp(p.headersUp, r, id, d.backends)
+	p.credentials.apply(r)
+	r = p.headers.identify(r, id)
+	return h.nextFor(r).ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), BackendsCtxKey, d.backends)))
 }
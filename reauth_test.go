@@ -1,14 +1,51 @@
 package reauth
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
 )
 
+func init() {
+	err := backend.Register("broken", func(config string) (backend.Backend, error) {
+		return brokenBackend{}, nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = backend.Register("slow", func(config string) (backend.Backend, error) {
+		d, err := time.ParseDuration(config)
+		return slowBackend{delay: d}, err
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+type brokenBackend struct{}
+
+func (brokenBackend) Authenticate(r *http.Request) (bool, error) {
+	return false, errors.New("backend unavailable")
+}
+
+type slowBackend struct {
+	delay time.Duration
+}
+
+func (b slowBackend) Authenticate(r *http.Request) (bool, error) {
+	time.Sleep(b.delay)
+	_, _, ok := r.BasicAuth()
+	return ok, nil
+}
+
 func emptyHandler(w http.ResponseWriter, r *http.Request) (int, error) {
 	return http.StatusOK, nil
 }
@@ -94,3 +131,599 @@ func TestMiddlewareProvider(t *testing.T) {
 		t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
 	}
 }
+
+func TestMiddlewareIdentity(t *testing.T) {
+	test := `reauth {
+				path /test
+				identity_headers
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	var seen *http.Request
+	auth := &Reauth{
+		rules: rules,
+		next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			seen = r
+			return http.StatusOK, nil
+		}),
+	}
+
+	t.Log("Testing spoofed headers are removed")
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-User", "admin")
+	rec := httptest.NewRecorder()
+	if _, err := auth.ServeHTTP(rec, req); err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	}
+	if got := seen.Header.Get("X-Forwarded-User"); got != "" {
+		t.Errorf("Expected no user header, got `%v`", got)
+	}
+
+	t.Log("Testing identity is passed downstream")
+	req, _ = http.NewRequest("GET", "/test", nil)
+	req.SetBasicAuth("username", "password")
+	if _, err := auth.ServeHTTP(rec, req); err != nil {
+		t.Errorf("Unexpected error `%v`", err)
+	}
+	if got := seen.Header.Get("X-Forwarded-User"); got != "username" {
+		t.Errorf("Expected `username` got `%v`", got)
+	}
+	if got := seen.Context().Value(httpserver.RemoteUserCtxKey); got != "username" {
+		t.Errorf("Expected `username` got `%v`", got)
+	}
+	if id, _ := seen.Context().Value(IdentityCtxKey).(*backend.Identity); id == nil || id.Username != "username" {
+		t.Errorf("Expected identity for `username` got `%v`", id)
+	}
+}
+
+func TestMiddlewarePolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		user   string
+		pass   string
+		expect int
+	}{
+		{"any", "bob", "secret", http.StatusOK},
+		{"any", "alice", "secret", http.StatusOK},
+		{"all", "bob", "secret", http.StatusOK},
+		{"all", "alice", "secret", http.StatusUnauthorized},
+		{"quorum=2", "bob", "secret", http.StatusOK},
+		{"quorum=2", "alice", "secret", http.StatusUnauthorized},
+		{"quorum=1", "alice", "secret", http.StatusOK},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing policy %d (%s as %s)", i+1, tc.policy, tc.user)
+		c := caddy.NewTestController("http", `reauth {
+				path /
+				policy `+tc.policy+`
+				simple bob=secret,alice=secret
+				simple bob=secret
+			}`)
+
+		rules, err := parseConfiguration(c)
+		if err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+
+		auth := &Reauth{
+			rules: rules,
+			next:  httpserver.HandlerFunc(emptyHandler),
+		}
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth(tc.user, tc.pass)
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != tc.expect {
+			t.Errorf("Expected `%v` got `%v`", tc.expect, result)
+		}
+	}
+}
+
+func TestMiddlewareRequire(t *testing.T) {
+	test := `reauth {
+				path /test
+				require user alice
+				simple alice=secret,bob=secret
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	for user, expect := range map[string]int{"alice": http.StatusOK, "bob": http.StatusForbidden} {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.SetBasicAuth(user, "secret")
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != expect {
+			t.Errorf("Expected `%v` for %s got `%v`", expect, user, result)
+		}
+	}
+}
+
+func TestMiddlewareMethods(t *testing.T) {
+	tests := []struct {
+		config string
+		method string
+		expect int
+	}{
+		{`methods PUT POST DELETE`, http.MethodGet, http.StatusOK},
+		{`methods PUT POST DELETE`, http.MethodHead, http.StatusOK},
+		{`methods PUT POST DELETE`, http.MethodPut, http.StatusUnauthorized},
+		{`except_methods GET`, http.MethodGet, http.StatusOK},
+		{`except_methods GET`, http.MethodHead, http.StatusUnauthorized},
+		{`except_methods GET`, http.MethodPost, http.StatusUnauthorized},
+		{"except_methods GET\ntreat_as_get HEAD OPTIONS", http.MethodHead, http.StatusOK},
+		{"except_methods GET\ntreat_as_get HEAD OPTIONS", http.MethodOptions, http.StatusOK},
+		{"methods GET\ntreat_as_get HEAD", http.MethodHead, http.StatusUnauthorized},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing methods %d (%s with %q)", i+1, tc.method, tc.config)
+		c := caddy.NewTestController("http", `reauth {
+				path /
+				`+tc.config+`
+				simple username=password
+			}`)
+
+		rules, err := parseConfiguration(c)
+		if err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+
+		auth := &Reauth{
+			rules: rules,
+			next:  httpserver.HandlerFunc(emptyHandler),
+		}
+
+		req, _ := http.NewRequest(tc.method, "/", nil)
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != tc.expect {
+			t.Errorf("Expected `%v` got `%v`", tc.expect, result)
+		}
+	}
+}
+
+func TestMiddlewarePatterns(t *testing.T) {
+	test := `reauth {
+				path_glob /api/**
+				except_glob /api/*/health
+				except_regexp ^/api/public/
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	for path, expect := range map[string]int{
+		"/":                  http.StatusOK,
+		"/api/users":         http.StatusUnauthorized,
+		"/api/users/health":  http.StatusOK,
+		"/api/users/1/items": http.StatusUnauthorized,
+		"/api/public/thing":  http.StatusOK,
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != expect {
+			t.Errorf("Expected `%v` for %s got `%v`", expect, path, result)
+		}
+	}
+}
+
+func TestMiddlewareHosts(t *testing.T) {
+	test := `reauth {
+				path /
+				host admin.example.com
+				simple admin=secret
+			}
+			reauth {
+				path /
+				host *.example.com
+				except_host www.example.com
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	for host, expect := range map[string]int{
+		"admin.example.com": http.StatusUnauthorized,
+		"api.example.com":   http.StatusOK,
+		"www.example.com":   http.StatusOK,
+		"example.com":       http.StatusOK,
+	} {
+		req, _ := http.NewRequest("GET", "http://"+host+"/", nil)
+		req.SetBasicAuth("username", "password")
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != expect {
+			t.Errorf("Expected `%v` for %s got `%v`", expect, host, result)
+		}
+	}
+}
+
+func TestMiddlewareIP(t *testing.T) {
+	test := `reauth {
+				path /
+				ip allow=10.0.0.0/8,trusted_proxies=192.168.0.1
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	tests := []struct {
+		desc   string
+		remote string
+		xff    string
+		auth   bool
+		expect int
+	}{
+		{"allowed network without credentials", "10.1.1.1:1234", "", false, http.StatusOK},
+		{"other network without credentials", "203.0.113.1:1234", "", false, http.StatusUnauthorized},
+		{"other network with credentials", "203.0.113.1:1234", "", true, http.StatusOK},
+		{"spoofed forwarding header", "203.0.113.1:1234", "10.1.1.1", false, http.StatusUnauthorized},
+		{"allowed network behind proxy", "192.168.0.1:1234", "10.1.1.1", false, http.StatusOK},
+		{"other network behind proxy", "192.168.0.1:1234", "203.0.113.1", false, http.StatusUnauthorized},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing request %d (%s)", i+1, tc.desc)
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		if tc.xff != "" {
+			req.Header.Set("X-Forwarded-For", tc.xff)
+		}
+		if tc.auth {
+			req.SetBasicAuth("username", "password")
+		}
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != tc.expect {
+			t.Errorf("Expected `%v` got `%v`", tc.expect, result)
+		}
+	}
+}
+
+func TestMiddlewareOnError(t *testing.T) {
+	tests := []struct {
+		desc       string
+		config     string
+		expect     int
+		retryAfter string
+	}{
+		{`Default is to deny`, "broken x=y\nsimple username=password", http.StatusInternalServerError, ""},
+		{`Deny with retry after`, "on_error deny 30s\nbroken x=y\nsimple username=password", http.StatusServiceUnavailable, "30"},
+		{`Retry after rounds up`, "on_error deny 500ms\nbroken x=y\nsimple username=password", http.StatusServiceUnavailable, "1"},
+		{`Retry after rounds up to whole seconds`, "on_error deny 1500ms\nbroken x=y\nsimple username=password", http.StatusServiceUnavailable, "2"},
+		{`Continue to the next backend`, "on_error continue\nbroken x=y\nsimple username=password", http.StatusOK, ""},
+		{`Fail through the failure handler`, "on_error fail\nbroken x=y\nsimple username=password", http.StatusUnauthorized, ""},
+		{`Open lets the request through`, "on_error open\nbroken x=y\nsimple username=wrong", http.StatusOK, ""},
+		{`Backends can override the rule`, "on_error fail\nbroken x=y on_error=continue\nsimple username=password", http.StatusOK, ""},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing on_error %d (%s)", i+1, tc.desc)
+		c := caddy.NewTestController("http", `reauth {
+				path /
+				`+tc.config+`
+			}`)
+
+		rules, err := parseConfiguration(c)
+		if err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+
+		auth := &Reauth{
+			rules: rules,
+			next:  httpserver.HandlerFunc(emptyHandler),
+		}
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.SetBasicAuth("username", "password")
+		rec := httptest.NewRecorder()
+		result, _ := auth.ServeHTTP(rec, req)
+		if result != tc.expect {
+			t.Errorf("Expected `%v` got `%v`", tc.expect, result)
+		}
+		if got := rec.Header().Get("Retry-After"); got != tc.retryAfter {
+			t.Errorf("Expected Retry-After `%v` got `%v`", tc.retryAfter, got)
+		}
+	}
+}
+
+func TestMiddlewareAuthTimeout(t *testing.T) {
+	test := `reauth {
+				path /test
+				auth_timeout 20ms
+				slow 1s
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.SetBasicAuth("username", "password")
+
+	start := time.Now()
+	result, _ := auth.ServeHTTP(httptest.NewRecorder(), req)
+	if result != http.StatusInternalServerError {
+		t.Errorf("Expected `%v` got `%v`", http.StatusInternalServerError, result)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the slow backend to be abandoned, took %v", elapsed)
+	}
+}
+
+func TestMiddlewareParallel(t *testing.T) {
+	tests := []struct {
+		desc     string
+		config   string
+		expect   int
+		backends []string
+	}{
+		{
+			`First success wins`,
+			`reauth {
+				path /test
+				parallel
+				slow 1s
+				simple username=password
+			}`,
+			http.StatusOK,
+			[]string{"simple"},
+		}, {
+			`All must pass`,
+			`reauth {
+				path /test
+				parallel
+				policy all
+				slow 10ms
+				simple username=password
+			}`,
+			http.StatusOK,
+			[]string{"slow", "simple"},
+		}, {
+			`Success wins over errors`,
+			`reauth {
+				path /test
+				parallel
+				broken x=y
+				slow 10ms
+			}`,
+			http.StatusOK,
+			[]string{"slow"},
+		}, {
+			`Errors are handled in order`,
+			`reauth {
+				path /test
+				parallel
+				simple username=wrong
+				broken x=y
+			}`,
+			http.StatusInternalServerError,
+			[]string{"broken"},
+		}, {
+			`Errors can be ignored`,
+			`reauth {
+				path /test
+				parallel
+				simple username=wrong
+				broken x=y on_error=continue
+			}`,
+			http.StatusUnauthorized,
+			nil,
+		},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing parallel %d (%s)", i+1, tc.desc)
+		c := caddy.NewTestController("http", tc.config)
+
+		rules, err := parseConfiguration(c)
+		if err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+
+		for n := 0; n < 5; n++ {
+			req, _ := http.NewRequest("GET", "/test", nil)
+			req.SetBasicAuth("username", "password")
+
+			d := newDecision(req, rules[0])
+			start := time.Now()
+			res := rules[0].authenticate(req)
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("Expected slow backends to be cancelled, took %v", elapsed)
+			}
+
+			d.backends = res.passed
+			if res.err != nil {
+				d.backends = []string{res.backend}
+			}
+			if !reflect.DeepEqual(d.backends, tc.backends) {
+				t.Errorf("Expected backends %v got %v", tc.backends, d.backends)
+			}
+
+			auth := &Reauth{rules: rules, next: httpserver.HandlerFunc(emptyHandler)}
+			if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != tc.expect {
+				t.Errorf("Expected `%v` got `%v`", tc.expect, result)
+			}
+		}
+	}
+}
+
+func TestMiddlewareParallelRace(t *testing.T) {
+	test := `reauth {
+				path /test
+				parallel
+				slow 50ms
+				simple username=password
+				header_up X-Remote-User {{.Username}}
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			// Keep changing the headers while the slow backend is still running
+			for end := time.Now().Add(100 * time.Millisecond); time.Now().Before(end); {
+				r.Header.Set("X-Downstream", time.Now().String())
+				r.Header.Del("X-Downstream")
+			}
+			return http.StatusOK, nil
+		}),
+	}
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.SetBasicAuth("username", "password")
+	if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusOK {
+		t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
+	}
+	if v := req.Header.Get("X-Remote-User"); v != "username" {
+		t.Errorf("Expected X-Remote-User `username` got `%v`", v)
+	}
+}
+
+func TestMiddlewareCache(t *testing.T) {
+	test := `reauth {
+				path /test
+				simple username=password cache=1m,cache_negative=10s,cache_size=100
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	if _, ok := rules[0].backends[0].Backend.(*backend.Cache); !ok {
+		t.Fatalf("Expected *backend.Cache got %T", rules[0].backends[0].Backend)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.SetBasicAuth("username", "password")
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != http.StatusOK {
+			t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
+		}
+	}
+}
+
+func TestMiddlewareLockout(t *testing.T) {
+	test := `reauth {
+				path /test
+				lockout user=2,window=1m
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	for i, expect := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.RemoteAddr = "203.0.113.1:1234"
+		req.SetBasicAuth("username", "guess")
+		rec := httptest.NewRecorder()
+		result, err := auth.ServeHTTP(rec, req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != expect {
+			t.Errorf("Attempt %d expected `%v` got `%v`", i+1, expect, result)
+		}
+		if expect == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Error("Expected a Retry-After header")
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "203.0.113.1:1234"
+	req.SetBasicAuth("username", "password")
+	if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusTooManyRequests {
+		t.Errorf("Expected the correct password to be locked out too, got `%v`", result)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// Rule modes
+const (
+	modeEnforce    = "enforce"
+	modeReportOnly = "report_only"
+)
+
+// discardWriter swallows the response to requests evaluated by report only
+// rules
+type discardWriter struct {
+	header http.Header
+}
+
+func (d discardWriter) Header() http.Header         { return d.header }
+func (d discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardWriter) WriteHeader(int)             {}
+
+// evaluate decides on a copy of the request without sending a response,
+// used by report only rules which let every request through
+func (h Reauth) evaluate(r *http.Request, p Rule) {
+	er := r.WithContext(r.Context())
+	er.Header = cloneHeader(r.Header)
+
+	v := Reauth{next: httpserver.HandlerFunc(func(http.ResponseWriter, *http.Request) (int, error) {
+		return 0, nil
+	})}
+	v.protect(discardWriter{header: http.Header{}}, er, p)
+}
+
+// report records the decision of a report only rule
+func (d *decision) report() {
+	reportOnlyDecisions.WithLabelValues(d.rule, d.outcome).Inc()
+	if d.reason != "" {
+		log.Printf("[INFO] reauth: report only rule %s would %s %s %s: %s", d.rule, d.outcome, d.r.Method, d.r.URL.Path, d.reason)
+	} else {
+		log.Printf("[INFO] reauth: report only rule %s would %s %s %s", d.rule, d.outcome, d.r.Method, d.r.URL.Path)
+	}
+}
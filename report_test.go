@@ -0,0 +1,154 @@
+package reauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewareReportOnly(t *testing.T) {
+	test := `reauth {
+				name report-test
+				path /test
+				mode report_only
+				require user admin
+				credentials strip_authorization=true
+				simple username=password,admin=secret
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	var audit bytes.Buffer
+	rules[0].audit = &auditLog{output: "test", w: &audit}
+
+	var passed []*http.Request
+	auth := &Reauth{
+		rules: rules,
+		next: httpserver.HandlerFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+			passed = append(passed, r)
+			return http.StatusOK, nil
+		}),
+	}
+
+	tests := []struct {
+		desc     string
+		username string
+		password string
+		outcome  string
+	}{
+		{`No credentials`, "", "", outcomeDeny},
+		{`Not permitted`, "username", "password", outcomeForbidden},
+		{`Permitted`, "admin", "secret", outcomeAllow},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing report only %d (%s)", i+1, tc.desc)
+		audit.Reset()
+		before := testutil.ToFloat64(reportOnlyDecisions.WithLabelValues("report-test", tc.outcome))
+
+		req, _ := http.NewRequest("GET", "/test", nil)
+		if tc.username != "" {
+			req.SetBasicAuth(tc.username, tc.password)
+		}
+		rec := httptest.NewRecorder()
+		result, err := auth.ServeHTTP(rec, req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != http.StatusOK || len(rec.Header()) != 0 {
+			t.Errorf("Expected the request to be let through untouched, got `%v` %v", result, rec.Header())
+		}
+		if tc.username != "" && passed[len(passed)-1].Header.Get("Authorization") == "" {
+			t.Error("Expected the request to be passed on unchanged")
+		}
+
+		if after := testutil.ToFloat64(reportOnlyDecisions.WithLabelValues("report-test", tc.outcome)); after != before+1 {
+			t.Errorf("Expected the %s outcome to be counted", tc.outcome)
+		}
+
+		var entry auditEntry
+		if err := json.Unmarshal(audit.Bytes(), &entry); err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+		if entry.Outcome != tc.outcome || !entry.ReportOnly {
+			t.Errorf("Expected a report only %s entry, got %+v", tc.outcome, entry)
+		}
+	}
+
+	if len(passed) != len(tests) {
+		t.Errorf("Expected every request to be passed on, got %d", len(passed))
+	}
+}
+
+func TestMiddlewareReportOnlyShadowing(t *testing.T) {
+	test := `reauth {
+				path /
+				simple username=password
+			}
+			reauth {
+				name report-shadow
+				path /admin
+				mode report_only
+				require group admins
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	tests := []struct {
+		desc     string
+		path     string
+		username string
+		expect   int
+		reported string
+	}{
+		{`Other path without credentials`, "/other", "", http.StatusUnauthorized, ""},
+		{`Report only path without credentials`, "/admin/x", "", http.StatusUnauthorized, outcomeDeny},
+		{`Report only path with credentials`, "/admin/x", "username", http.StatusOK, outcomeForbidden},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing shadowed rule %d (%s)", i+1, tc.desc)
+		var before float64
+		if tc.reported != "" {
+			before = testutil.ToFloat64(reportOnlyDecisions.WithLabelValues("report-shadow", tc.reported))
+		}
+
+		req, _ := http.NewRequest("GET", tc.path, nil)
+		if tc.username != "" {
+			req.SetBasicAuth(tc.username, "password")
+		}
+		result, err := auth.ServeHTTP(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Errorf("Unexpected error `%v`", err)
+		}
+		if result != tc.expect {
+			t.Errorf("Expected `%v` got `%v`", tc.expect, result)
+		}
+
+		if tc.reported != "" {
+			if after := testutil.ToFloat64(reportOnlyDecisions.WithLabelValues("report-shadow", tc.reported)); after != before+1 {
+				t.Errorf("Expected the %s outcome to be reported", tc.reported)
+			}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// requirements restrict which authenticated identities may access a rule
+type requirements struct {
+	users  []string
+	groups []string
+}
+
+func (q requirements) empty() bool {
+	return len(q.users) == 0 && len(q.groups) == 0
+}
+
+// permits returns true if the identity is one of the required users or a member
+// of one of the required groups
+func (q requirements) permits(id *backend.Identity) bool {
+	if q.empty() {
+		return true
+	}
+
+	if containsString(q.users, id.Username) {
+		return true
+	}
+
+	for _, g := range id.Groups {
+		if containsString(q.groups, g) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,30 @@
+package reauth
+
+import (
+	"testing"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+func TestRequirements(t *testing.T) {
+	tests := []struct {
+		desc    string
+		require requirements
+		id      *backend.Identity
+		expect  bool
+	}{
+		{`No requirements`, requirements{}, &backend.Identity{Username: "bob"}, true},
+		{`Required user`, requirements{users: []string{"alice", "bob"}}, &backend.Identity{Username: "bob"}, true},
+		{`Other user`, requirements{users: []string{"alice"}}, &backend.Identity{Username: "bob"}, false},
+		{`Required group`, requirements{groups: []string{"ops"}}, &backend.Identity{Username: "bob", Groups: []string{"dev", "ops"}}, true},
+		{`Other group`, requirements{groups: []string{"ops"}}, &backend.Identity{Username: "bob", Groups: []string{"dev"}}, false},
+		{`User or group`, requirements{users: []string{"bob"}, groups: []string{"ops"}}, &backend.Identity{Username: "bob"}, true},
+	}
+
+	for i, tc := range tests {
+		t.Logf("Testing requirement %d (%s)", i+1, tc.desc)
+		if got := tc.require.permits(tc.id); got != tc.expect {
+			t.Errorf("Expected %v got %v", tc.expect, got)
+		}
+	}
+}
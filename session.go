@@ -0,0 +1,364 @@
+/*
+ * The MIT License (MIT)
+ *
+ * Copyright (c) 2017 Shannon Wynter
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package reauth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/freman/caddy-reauth/backend"
+)
+
+// Session defaults
+const (
+	DefaultSessionName     = "reauth_session"
+	DefaultSessionLifetime = 12 * time.Hour
+)
+
+// sessionBackend is the name sessions are recorded under in place of a backend
+const sessionBackend = "session"
+
+// sessionKey is derived from a configured secret
+type sessionKey struct {
+	sign    []byte
+	encrypt []byte
+}
+
+func deriveKey(secret string) sessionKey {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(purpose))
+		return mac.Sum(nil)
+	}
+	return sessionKey{sign: derive("reauth session signing"), encrypt: derive("reauth session encryption")}
+}
+
+// sessions issues and verifies signed, optionally encrypted, session cookies
+// carrying the authenticated identity. The first key signs new sessions and
+// every key is accepted to permit rotation.
+type sessions struct {
+	keys     []sessionKey
+	name     string
+	domain   string
+	path     string
+	lifetime time.Duration
+	sliding  bool
+	encrypt  bool
+
+	mu      sync.Mutex
+	revoked map[string]int64
+}
+
+// sessionPayload is the content of a session cookie
+type sessionPayload struct {
+	ID       string            `json:"id,omitempty"`
+	Username string            `json:"u,omitempty"`
+	Groups   []string          `json:"g,omitempty"`
+	Claims   map[string]string `json:"c,omitempty"`
+	Issued   int64             `json:"iat"`
+	Expires  int64             `json:"exp"`
+}
+
+func parseSessions(config string) (*sessions, error) {
+	options, err := backend.ParseOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &sessions{
+		name:     DefaultSessionName,
+		path:     "/",
+		lifetime: DefaultSessionLifetime,
+	}
+
+	for k, v := range options {
+		switch k {
+		case "keys":
+			for _, secret := range strings.Split(v, ",") {
+				if len(secret) < 16 {
+					return nil, errors.New("keys must be at least 16 characters")
+				}
+				s.keys = append(s.keys, deriveKey(secret))
+			}
+		case "name":
+			s.name = v
+		case "domain":
+			s.domain = v
+		case "path":
+			s.path = v
+		case "lifetime":
+			if s.lifetime, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("unable to parse lifetime %s: %v", v, err)
+			}
+		case "sliding":
+			if s.sliding, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("unable to parse sliding %s: %v", v, err)
+			}
+		case "encrypt":
+			if s.encrypt, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("unable to parse encrypt %s: %v", v, err)
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %v", k)
+		}
+	}
+
+	if len(s.keys) == 0 {
+		return nil, errors.New("keys is a required parameter")
+	}
+
+	if s.lifetime <= 0 {
+		return nil, errors.New("lifetime must be positive")
+	}
+
+	return s, nil
+}
+
+// identity returns the identity from a valid session cookie, renewing the
+// cookie if sliding sessions are enabled or it was signed with an old key
+func (s *sessions) identity(w http.ResponseWriter, r *http.Request) (*backend.Identity, bool) {
+	c, err := r.Cookie(s.name)
+	if err != nil {
+		return nil, false
+	}
+
+	p, current, err := s.decode(c.Value)
+	if err != nil {
+		return nil, false
+	}
+
+	now := time.Now()
+	if now.Unix() >= p.Expires || s.isRevoked(p.ID) {
+		return nil, false
+	}
+
+	id := &backend.Identity{Username: p.Username, Groups: p.Groups, Claims: p.Claims}
+
+	renew := !current
+	if s.sliding && now.Sub(time.Unix(p.Issued, 0)) > s.lifetime/2 {
+		renew = true
+	}
+	if renew {
+		if err := s.issue(w, r, id); err != nil {
+			return nil, false
+		}
+	}
+
+	return id, true
+}
+
+// issue sets a new session cookie for the identity
+func (s *sessions) issue(w http.ResponseWriter, r *http.Request, id *backend.Identity) error {
+	sid := make([]byte, 16)
+	if _, err := rand.Read(sid); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	value, err := s.encode(sessionPayload{
+		ID:       base64.RawURLEncoding.EncodeToString(sid),
+		Username: id.Username,
+		Groups:   id.Groups,
+		Claims:   id.Claims,
+		Issued:   now.Unix(),
+		Expires:  now.Add(s.lifetime).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, s.cookie(r, value, now.Add(s.lifetime)))
+	return nil
+}
+
+// revoke invalidates the session cookie in the request until it would have
+// expired, clearing it from the client, and returns the identity it carried
+func (s *sessions) revoke(w http.ResponseWriter, r *http.Request) *backend.Identity {
+	c, err := r.Cookie(s.name)
+	if err != nil {
+		return nil
+	}
+
+	expired := s.cookie(r, "", time.Unix(0, 0))
+	expired.MaxAge = -1
+	http.SetCookie(w, expired)
+
+	p, _, err := s.decode(c.Value)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now().Unix()
+
+	s.mu.Lock()
+	if s.revoked == nil {
+		s.revoked = map[string]int64{}
+	}
+	for sid, expires := range s.revoked {
+		if now >= expires {
+			delete(s.revoked, sid)
+		}
+	}
+	if p.ID != "" && now < p.Expires {
+		s.revoked[p.ID] = p.Expires
+	}
+	s.mu.Unlock()
+
+	return &backend.Identity{Username: p.Username, Groups: p.Groups, Claims: p.Claims}
+}
+
+func (s *sessions) isRevoked(sid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.revoked[sid]
+	return found
+}
+
+func (s *sessions) cookie(r *http.Request, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.name,
+		Value:    value,
+		Domain:   s.domain,
+		Path:     s.path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func (s *sessions) encode(p sessionPayload) (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+
+	key := s.keys[0]
+	if s.encrypt {
+		if data, err = seal(key.encrypt, data); err != nil {
+			return "", err
+		}
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(key.sign, payload)), nil
+}
+
+// decode verifies and decodes a session cookie value, reporting whether it
+// was signed with the current key
+func (s *sessions) decode(value string) (sessionPayload, bool, error) {
+	var p sessionPayload
+
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return p, false, errors.New("malformed session")
+	}
+
+	payload := value[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(value[i+1:])
+	if err != nil {
+		return p, false, err
+	}
+
+	for n, key := range s.keys {
+		if !hmac.Equal(mac, sign(key.sign, payload)) {
+			continue
+		}
+
+		data, err := base64.RawURLEncoding.DecodeString(payload)
+		if err != nil {
+			return p, false, err
+		}
+
+		if s.encrypt {
+			if data, err = open(key.encrypt, data); err != nil {
+				return p, false, err
+			}
+		}
+
+		dec := json.NewDecoder(bytes.NewReader(data))
+		if err := dec.Decode(&p); err != nil {
+			return p, false, err
+		}
+
+		return p, n == 0, nil
+	}
+
+	return p, false, errors.New("invalid session signature")
+}
+
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func seal(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("malformed session")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
@@ -0,0 +1,180 @@
+package reauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/freman/caddy-reauth/backend"
+)
+
+func TestSessions(t *testing.T) {
+	id := &backend.Identity{Username: "bob", Groups: []string{"ops"}, Claims: map[string]string{"mail": "bob@example.com"}}
+
+	for _, encrypt := range []string{"false", "true"} {
+		t.Logf("Testing sessions with encrypt=%s", encrypt)
+		s, err := parseSessions(`keys="0123456789abcdef",lifetime=1h,encrypt=` + encrypt)
+		if err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+
+		rec := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/", nil)
+		if err := s.issue(rec, r, id); err != nil {
+			t.Fatalf("Unexpected error `%v`", err)
+		}
+
+		cookie := rec.Result().Cookies()[0]
+		if cookie.Name != DefaultSessionName || !cookie.HttpOnly {
+			t.Errorf("Unexpected cookie %v", cookie)
+		}
+		if encrypt == "true" && strings.Contains(cookie.Value, "Ym9i") {
+			t.Error("Expected the session to be encrypted")
+		}
+
+		r.AddCookie(cookie)
+		got, ok := s.identity(httptest.NewRecorder(), r)
+		if !ok {
+			t.Fatal("Expected a valid session")
+		}
+		if got.Username != "bob" || len(got.Groups) != 1 || got.Claims["mail"] != "bob@example.com" {
+			t.Errorf("Unexpected identity %v", got)
+		}
+
+		t.Log("Testing tampered sessions are rejected")
+		r, _ = http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: DefaultSessionName, Value: "x" + cookie.Value})
+		if _, ok := s.identity(httptest.NewRecorder(), r); ok {
+			t.Error("Expected the session to be rejected")
+		}
+	}
+}
+
+func TestSessionRotation(t *testing.T) {
+	old, _ := parseSessions(`keys="0123456789abcdef"`)
+	rotated, _ := parseSessions(`keys="fedcba9876543210,0123456789abcdef"`)
+	other, _ := parseSessions(`keys="fedcba9876543210"`)
+
+	rec := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	old.issue(rec, r, &backend.Identity{Username: "bob"})
+	r.AddCookie(rec.Result().Cookies()[0])
+
+	if _, ok := other.identity(httptest.NewRecorder(), r); ok {
+		t.Error("Expected sessions signed with unknown keys to be rejected")
+	}
+
+	rec = httptest.NewRecorder()
+	if _, ok := rotated.identity(rec, r); !ok {
+		t.Error("Expected sessions signed with old keys to be accepted")
+	}
+	if len(rec.Result().Cookies()) != 1 {
+		t.Error("Expected sessions signed with old keys to be renewed")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	s, _ := parseSessions(`keys="0123456789abcdef",lifetime=1h,sliding=true`)
+
+	issue := func(issued time.Time) *http.Request {
+		value, _ := s.encode(sessionPayload{Username: "bob", Issued: issued.Unix(), Expires: issued.Add(s.lifetime).Unix()})
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.AddCookie(&http.Cookie{Name: s.name, Value: value})
+		return r
+	}
+
+	if _, ok := s.identity(httptest.NewRecorder(), issue(time.Now().Add(-2*time.Hour))); ok {
+		t.Error("Expected expired sessions to be rejected")
+	}
+
+	rec := httptest.NewRecorder()
+	if _, ok := s.identity(rec, issue(time.Now())); !ok || len(rec.Result().Cookies()) != 0 {
+		t.Error("Expected fresh sessions to be accepted without renewal")
+	}
+
+	rec = httptest.NewRecorder()
+	if _, ok := s.identity(rec, issue(time.Now().Add(-45*time.Minute))); !ok || len(rec.Result().Cookies()) != 1 {
+		t.Error("Expected old sessions to be renewed")
+	}
+}
+
+func TestMiddlewareSession(t *testing.T) {
+	test := `reauth {
+				path /test
+				session keys="0123456789abcdef"
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.SetBasicAuth("username", "password")
+	rec := httptest.NewRecorder()
+	if result, _ := auth.ServeHTTP(rec, req); result != http.StatusOK {
+		t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a session cookie, got %v", cookies)
+	}
+
+	req, _ = http.NewRequest("GET", "/test", nil)
+	req.AddCookie(cookies[0])
+	if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusOK {
+		t.Errorf("Expected the session to be accepted, got `%v`", result)
+	}
+}
+
+func TestMiddlewareSessionRequestBound(t *testing.T) {
+	test := `reauth {
+				path /test
+				session keys="0123456789abcdef"
+				policy all
+				ip allow=10.0.0.0/8
+				simple username=password
+			}`
+	c := caddy.NewTestController("http", test)
+
+	rules, err := parseConfiguration(c)
+	if err != nil {
+		t.Fatalf("Unexpected error `%v`", err)
+	}
+
+	auth := &Reauth{
+		rules: rules,
+		next:  httpserver.HandlerFunc(emptyHandler),
+	}
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "10.1.1.1:1234"
+	req.SetBasicAuth("username", "password")
+	rec := httptest.NewRecorder()
+	if result, _ := auth.ServeHTTP(rec, req); result != http.StatusOK {
+		t.Errorf("Expected `%v` got `%v`", http.StatusOK, result)
+	}
+
+	if cookies := rec.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected no session for an identity that depends on the client, got %v", cookies)
+	}
+
+	req, _ = http.NewRequest("GET", "/test", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	req.SetBasicAuth("username", "password")
+	if result, _ := auth.ServeHTTP(httptest.NewRecorder(), req); result != http.StatusUnauthorized {
+		t.Errorf("Expected `%v` got `%v`", http.StatusUnauthorized, result)
+	}
+}